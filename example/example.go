@@ -13,15 +13,14 @@ import (
 )
 
 var (
-	allTickets tickets.Tickets
-	f          *fsn.Grail
+	f *fsn.Grail
 )
 
 func main() {
-	loadTicketsFromStorage()
 	f = &fsn.Grail{
 		EtcdEndpoints:           []string{"127.0.0.1:2379"},
-		DispatchHandler:         masterDispatchHandler,
+		DispatchStrategy:        master.Chain(master.TicketsStrategy(master.ConservativeAverageDispatch), master.LoggingMiddleware()),
+		TicketSource:            master.TicketsFunc(loadTicketsFromStorage),
 		ServantHandler:          servantHandler,
 		SysFetcher:              sysFetcher, // optional
 		MaxServantInProccess:    2,
@@ -41,23 +40,6 @@ func main() {
 	<-sigchan
 }
 
-func masterDispatchHandler(lastDisptch *master.CurrentDispatch, newDispatch *master.NewDispatch) error {
-	fmt.Println("==================current dispatch==================")
-	for _, s := range lastDisptch.ServantPayloads {
-		fmt.Printf("servant %v tickets: %s system info:%s\n", s.ServantID, s.Tickets.Summary(), string(s.SystemStats))
-	}
-	fmt.Println("==================current dispatch==================")
-
-	master.ConservativeAverageDispatch(allTickets, lastDisptch, newDispatch)
-
-	fmt.Println("==================new dispatch==================")
-	for _, s := range newDispatch.ServantPayloads {
-		fmt.Printf("servant %v tickets: %s\n", s.ServantID, s.Tickets.Summary())
-	}
-	fmt.Println("==================new dispatch==================")
-	return nil
-}
-
 func servantHandler(t tickets.Ticket) error {
 	fmt.Printf("consume ticket id:%s data:%s\n", t.ID, string(t.Content))
 	return nil
@@ -68,10 +50,14 @@ func sysFetcher() ([]byte, error) {
 	return []byte(info), nil
 }
 
-func loadTicketsFromStorage() {
+func loadTicketsFromStorage() (tickets.Tickets, error) {
+	var allTickets tickets.Tickets
 	text := `[{"ID":"1","Content":"ZTM2NTc2NzcxNjU2MDBjMTdiYmE1YmY2MDc5ZDdjNzA=","Type":0},{"ID":"2","Content":"NWNmZTkzOWQ2ODEwODUwMWIxYWQ3Y2Y1NGJlNWE5OTU=","Type":0},{"ID":"3","Content":"Nzk1ODNlYjIxZWQxZTNhZjhmZTkwNzBkNjVmYzZlZWQ=","Type":0},{"ID":"4","Content":"YzlmZjY2MGNhNTQ5MjRkNzBjZWE4Y2I1OWE3OTRiNjc=","Type":0},{"ID":"5","Content":"MTUxMTZkZjNkZGQyMjY4NzE2ODQ3MWI5ODdkMDE2ODc=","Type":0}]`
-	json.Unmarshal([]byte(text), &allTickets)
+	if err := json.Unmarshal([]byte(text), &allTickets); err != nil {
+		return nil, err
+	}
 	for i := range allTickets {
 		allTickets[i].Type = tickets.SolidTicket
 	}
+	return allTickets, nil
 }
@@ -1,6 +1,7 @@
 package fsn
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -15,26 +16,76 @@ import (
 	"github.com/qjpcpu/servant-cluster/util"
 	"go.etcd.io/etcd/clientv3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
 )
 
+var errMasterNotStarted = errors.New("master is not started")
+
 type Grail struct {
 	// config fields
 	// etcd endpoints
 	EtcdEndpoints []string
+	// etcd client tls config, nil for plain connection
+	EtcdTLS *tls.Config
+	// etcd auth
+	EtcdUsername string
+	EtcdPassword string
 	// dispatch implements of master
 	DispatchHandler master.DispatchHandler
+	// dispatch strategy of master, takes precedence over DispatchHandler
+	DispatchStrategy master.DispatchStrategy
+	// full ticket catalog for DispatchStrategy
+	TicketSource master.TicketSource
+	// use tickets stored under <EtcdPrefix>/tickets/ as catalog when TicketSource is nil
+	UseEtcdTickets bool
 	// ticket servant handler of servant
 	ServantHandler servant.ServantHandler
-	// report servant current system info
+	// ticket handler of servant interrupted by ticket revocation and Shutdown, takes precedence over ServantHandler
+	ServantContextHandler servant.ContextHandler
+	// ownership mode of servant, every assigned ticket is owned by its own goroutine until revoked,
+	// takes precedence over other handlers and MaxServantInProccess is ignored
+	ServantOwnHandler servant.OwnHandler
+	// retry policy of failed tickets by ticket type, failed tickets of other types are retried at schedule interval
+	RetryPolicies map[tickets.TicketType]tickets.RetryPolicy
+	// report servant current system info, wrap with tickets.WeightedSysInfoGetter to work with master.WeightedDispatch
 	SysFetcher tickets.SysInfoGetter
 	// max servant parallel in proccess
 	MaxServantInProccess int
+	// labels advertised by servants of this process
+	ServantLabels map[string]string
 	// ip of current host
 	IP string
 	// etcd key prefix for ha and servants cluster
 	EtcdPrefix string
 	// master schedule interval
 	MasterScheduleInterval time.Duration
+	// master election session ttl in seconds, default 15
+	MasterElectionTTL int
+	// master election, default elects with etcd lease on etcd client of Grail
+	MasterElector master.Elector
+	// max parallel rpc calls from master to servants
+	MasterConcurrency int
+	// deadline of every rpc call from master to servant
+	MasterRPCTimeout time.Duration
+	// consecutive failed rpc calls after which master moves tickets off a servant, default 3
+	MasterUnhealthyThreshold int
+	// max dispatch records kept by master, default 1000
+	MasterHistoryLimit int
+	// master moves tickets not started by servant within this timeout to another servant, 0 disables
+	MasterAckTimeout time.Duration
+	// master collapses bursts of cluster changes into one dispatch round after this quiet window
+	MasterTriggerDebounce time.Duration
+	// max delay of master dispatch round since the first change of a burst
+	MasterTriggerMaxDelay time.Duration
+	// master revokes a moving ticket and grants it to new owner in a later round after old owner finishes it
+	ExclusiveHandoff bool
+	// called when this process becomes master
+	OnBecomeLeader func()
+	// called when this process is no longer master
+	OnLoseLeadership func()
+	// tasks run only while this process is master
+	LeaderTasks []master.LeaderTask
 	// servant worker schedule interval for
 	ServantScheduleInterval time.Duration
 	// Grail log file
@@ -63,6 +114,9 @@ func (f *Grail) Boot() error {
 	}
 	// create ticket queue
 	f.tq = tickets.NewQueue()
+	for tp, p := range f.RetryPolicies {
+		f.tq.SetRetryPolicy(tp, p)
+	}
 	// start grpc server
 	tserver, err := f.startServantServer()
 	if err != nil {
@@ -97,7 +151,7 @@ func (f *Grail) setupLog() {
 }
 
 func (f *Grail) startServant() error {
-	if f.ServantHandler == nil {
+	if f.ServantHandler == nil && f.ServantContextHandler == nil && f.ServantOwnHandler == nil {
 		return errors.New("no ServantHandler found")
 	}
 	if f.EtcdPrefix == "" {
@@ -112,9 +166,16 @@ func (f *Grail) startServant() error {
 	sb := servant.Builder()
 	sb.SetTicketsQueue(f.tq)
 	sb.SetEtcdCli(f.etcdCli)
-	sb.SetServantHandler(f.ServantHandler)
+	if f.ServantOwnHandler != nil {
+		sb.SetOwnHandler(f.ServantOwnHandler)
+	} else if f.ServantContextHandler != nil {
+		sb.SetContextHandler(f.ServantContextHandler)
+	} else {
+		sb.SetServantHandler(f.ServantHandler)
+	}
 	sb.SetKeyPrefix(f.EtcdPrefix)
 	sb.SetServantID(f.IP + f.port)
+	sb.SetLabels(f.ServantLabels)
 	sb.SetServantMaxNum(f.MaxServantInProccess)
 	sb.SetInterval(f.ServantScheduleInterval)
 	f.servantPool = sb.Run()
@@ -122,18 +183,38 @@ func (f *Grail) startServant() error {
 }
 
 func (f *Grail) startMaster() error {
-	if f.DispatchHandler == nil {
-		return errors.New("no DispatchHandler found")
+	if f.DispatchHandler == nil && f.DispatchStrategy == nil {
+		return errors.New("no DispatchHandler or DispatchStrategy found")
 	}
 	if f.EtcdPrefix == "" {
 		return errors.New("bad etcd EtcdPrefix key")
 	}
+	if f.TicketSource == nil && f.UseEtcdTickets {
+		f.TicketSource = master.NewEtcdTicketSource(f.etcdCli, f.EtcdPrefix)
+	}
 	f.masterCtrl = &master.Master{
-		HaEtcdEndpoints:  f.EtcdEndpoints,
-		Prefix:           f.EtcdPrefix,
-		ScheduleInterval: f.MasterScheduleInterval,
-		DispatchHandler:  f.DispatchHandler,
-		EtcdCli:          f.etcdCli,
+		ID:                 f.Addr(),
+		Prefix:             f.EtcdPrefix,
+		ScheduleInterval:   f.MasterScheduleInterval,
+		DispatchHandler:    f.DispatchHandler,
+		DispatchStrategy:   f.DispatchStrategy,
+		TicketSource:       f.TicketSource,
+		EtcdCli:            f.etcdCli,
+		Elector:            f.MasterElector,
+		ElectionTTL:        f.MasterElectionTTL,
+		ExclusiveHandoff:   f.ExclusiveHandoff,
+		Concurrency:        f.MasterConcurrency,
+		RPCTimeout:         f.MasterRPCTimeout,
+		TriggerDebounce:    f.MasterTriggerDebounce,
+		TriggerMaxDelay:    f.MasterTriggerMaxDelay,
+		UnhealthyThreshold: f.MasterUnhealthyThreshold,
+		HistoryLimit:       f.MasterHistoryLimit,
+		AckTimeout:         f.MasterAckTimeout,
+		OnBecomeLeader:     f.OnBecomeLeader,
+		OnLoseLeadership:   f.OnLoseLeadership,
+	}
+	for _, task := range f.LeaderTasks {
+		f.masterCtrl.RunAsLeader(task)
 	}
 	go f.masterCtrl.Run()
 	return nil
@@ -143,7 +224,12 @@ func (f *Grail) connectEtcd() error {
 	if len(f.EtcdEndpoints) == 0 {
 		return errors.New("bad etcd config")
 	}
-	cli, err := clientv3.New(clientv3.Config{Endpoints: f.EtcdEndpoints})
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints: f.EtcdEndpoints,
+		TLS:       f.EtcdTLS,
+		Username:  f.EtcdUsername,
+		Password:  f.EtcdPassword,
+	})
 	if err != nil {
 		return err
 	}
@@ -159,7 +245,11 @@ func (f *Grail) startServantServer() (*servant.TicketInfoServer, error) {
 	}
 	port := ln.Addr().(*net.TCPAddr).Port
 	server.Addr = fmt.Sprintf(":%d", port)
-	grpcServer := grpc.NewServer()
+	// permit keepalive of master persistent connections
+	grpcServer := grpc.NewServer(grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             10 * time.Second,
+		PermitWithoutStream: true,
+	}))
 	proto.RegisterTicketDispatcherServer(grpcServer, server)
 	fmt.Printf("Listening and serving grpc on %s\n", server.Addr)
 	go grpcServer.Serve(ln)
@@ -172,8 +262,86 @@ func (f *Grail) RequestMasterReschedule() {
 	f.servantPool.RequestMasterReschedule()
 }
 
+// PutTicket add or update ticket of etcd ticket catalog
+func (f *Grail) PutTicket(tk tickets.Ticket) error {
+	return master.NewEtcdTicketSource(f.etcdCli, f.EtcdPrefix).Put(tk)
+}
+
+// DeleteTicket remove ticket from etcd ticket catalog
+func (f *Grail) DeleteTicket(id string) error {
+	return master.NewEtcdTicketSource(f.etcdCli, f.EtcdPrefix).Delete(id)
+}
+
+// PlanDispatch preview the dispatch of current DispatchHandler against live cluster without applying it
+func (f *Grail) PlanDispatch() (*master.DispatchPlan, error) {
+	if f.masterCtrl == nil {
+		return nil, errMasterNotStarted
+	}
+	return f.masterCtrl.Plan()
+}
+
+// RunAsLeader run task only while this process is master, ctx of task is cancelled on demotion,
+// tasks registered before Boot are started with master
+func (f *Grail) RunAsLeader(task master.LeaderTask) {
+	if f.masterCtrl == nil {
+		f.LeaderTasks = append(f.LeaderTasks, task)
+		return
+	}
+	f.masterCtrl.RunAsLeader(task)
+}
+
+// DispatchHistory return at most limit dispatch rounds, newest first
+func (f *Grail) DispatchHistory(limit int) ([]master.DispatchRecord, error) {
+	if f.masterCtrl == nil {
+		return nil, errMasterNotStarted
+	}
+	return f.masterCtrl.DispatchHistory(limit)
+}
+
+// DeadLetters collect tickets given up by servants after retries, it stays dead lettered until master pushes tickets to its servant again
+func (f *Grail) DeadLetters() ([]master.DeadLetter, error) {
+	if f.masterCtrl == nil {
+		return nil, errMasterNotStarted
+	}
+	return f.masterCtrl.DeadLetters()
+}
+
+// ServantConnStates return states of connections this process keeps to servants while it is master
+func (f *Grail) ServantConnStates() map[string]connectivity.State {
+	if f.masterCtrl == nil {
+		return nil
+	}
+	return f.masterCtrl.ConnStates()
+}
+
+// ResignMaster step down if this process is master so a standby takes over at once
+func (f *Grail) ResignMaster() error {
+	if f.masterCtrl == nil {
+		return nil
+	}
+	return f.masterCtrl.Resign("")
+}
+
+// TransferMaster step down if this process is master and prefer successor as next master,
+// successor is Addr of another Grail, any standby takes over if it is gone
+func (f *Grail) TransferMaster(successor string) error {
+	if f.masterCtrl == nil {
+		return nil
+	}
+	return f.masterCtrl.Resign(successor)
+}
+
+// IsMaster report whether this process is master now
+func (f *Grail) IsMaster() bool {
+	return f.masterCtrl != nil && f.masterCtrl.IsLeader()
+}
+
 func (f *Grail) Shutdown() {
 	if atomic.CompareAndSwapInt32(&f.stopped, 0, 1) {
+		// hand over master before stopping anything
+		if err := f.ResignMaster(); err != nil {
+			log.M(util.ModuleName).Warningf("resign master fail:%v", err)
+		}
 		// stop master
 		f.masterCtrl.Stop()
 		// stop servants
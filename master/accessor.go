@@ -11,6 +11,12 @@ type ServantPayload struct {
 	ServantID   string
 	Tickets     tickets.Tickets
 	SystemStats []byte
+	// labels advertised by servant
+	Labels map[string]string
+	// rpc health of servant observed by master
+	Health ServantHealth
+	// ticket id to its state on servant, nil when servant does not report
+	States map[string]tickets.TicketStatus
 }
 
 type ServantPayloads []ServantPayload
@@ -31,6 +37,8 @@ type CurrentDispatch struct {
 type NewDispatch struct {
 	ForceFlush      bool
 	ServantPayloads ServantPayloads
+	// tickets intentionally left out by dispatch
+	Unassigned tickets.Tickets
 }
 
 func (sp ServantPayloads) Equals(sp1 ServantPayloads) bool {
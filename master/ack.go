@@ -0,0 +1,69 @@
+package master
+
+import (
+	"time"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// unackedTickets return ticket id to servant for tickets no worker started within timeout
+func unackedTickets(sid string, states map[string]tickets.TicketStatus, timeout time.Duration) map[string]string {
+	stale := make(map[string]string)
+	for id, st := range states {
+		if st.State == tickets.TicketAssigned && time.Since(st.Since) > timeout {
+			stale[id] = sid
+		}
+	}
+	return stale
+}
+
+// UnackedMiddleware move unacknowledged tickets dispatched back to the same servant by strategy
+// to the least loaded other servant with matching labels and spare capacity, grouped tickets stay with their group,
+// master applies it after strategy when AckTimeout is set, place it inside constraint and churn middlewares
+// so moves are checked and counted
+func UnackedMiddleware() Middleware {
+	return func(next DispatchStrategy) DispatchStrategy {
+		return DispatchStrategyFunc(func(ctx *DispatchContext, newDis *NewDispatch) error {
+			if err := next.Dispatch(ctx, newDis); err != nil {
+				return err
+			}
+			reassignUnacked(ctx.Current, ctx.Unacked, newDis)
+			return nil
+		})
+	}
+}
+
+func reassignUnacked(last *CurrentDispatch, stale map[string]string, newDis *NewDispatch) {
+	if len(stale) == 0 {
+		return
+	}
+	servants := servantsOf(last)
+	for i := range newDis.ServantPayloads {
+		from := &newDis.ServantPayloads[i]
+		for _, tk := range from.Tickets {
+			if stale[tk.ID] != from.ServantID || tk.Group != "" {
+				continue
+			}
+			to := -1
+			for j, p := range newDis.ServantPayloads {
+				if j == i || !tk.MatchLabels(servants[p.ServantID].Labels) {
+					continue
+				}
+				if c := ServantCapacity(servants[p.ServantID]); c >= 0 && len(p.Tickets) >= c {
+					continue
+				}
+				if to < 0 || len(p.Tickets) < len(newDis.ServantPayloads[to].Tickets) {
+					to = j
+				}
+			}
+			if to < 0 {
+				continue
+			}
+			log.M(util.ModuleName).Warningf("ticket %s not acknowledged by %s, reassign to %s", tk.ID, from.ServantID, newDis.ServantPayloads[to].ServantID)
+			from.Tickets = removeTicket(from.Tickets, tk.ID)
+			newDis.ServantPayloads[to].Tickets = appendTicket(newDis.ServantPayloads[to].Tickets, tk)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// Assignment is the committed dispatch stored in etcd, a newly elected master starts from it
+type Assignment struct {
+	MasterID string `json:"master_id"`
+	Epoch    int64  `json:"epoch"`
+	// servant id to ticket ids, content is kept by ticket catalog
+	Servants map[string][]string `json:"servants"`
+}
+
+func newAssignment(masterID string, epoch int64, sp ServantPayloads) *Assignment {
+	a := &Assignment{MasterID: masterID, Epoch: epoch, Servants: make(map[string][]string)}
+	for _, p := range sp {
+		ids := []string{}
+		for _, tk := range p.Tickets {
+			ids = append(ids, tk.ID)
+		}
+		a.Servants[p.ServantID] = ids
+	}
+	return a
+}
+
+// Payloads convert assignment to payloads, tickets content is resolved from catalog,
+// tickets absent in catalog are left out so no ticket known by id only is dispatched
+func (a *Assignment) Payloads(catalog tickets.Tickets) ServantPayloads {
+	catalogM := make(map[string]tickets.Ticket)
+	for _, tk := range catalog {
+		catalogM[tk.ID] = tk
+	}
+	var sp ServantPayloads
+	for sid, ids := range a.Servants {
+		p := ServantPayload{ServantID: sid}
+		for _, id := range ids {
+			if tk, ok := catalogM[id]; ok {
+				p.Tickets = append(p.Tickets, tk)
+			}
+		}
+		sp = append(sp, p)
+	}
+	return sp
+}
+
+// refreshTickets return tickets of servants in sp with content updated from catalog
+func refreshTickets(sp ServantPayloads, catalog tickets.Tickets) map[string]tickets.Tickets {
+	catalogM := make(map[string]tickets.Ticket)
+	for _, tk := range catalog {
+		catalogM[tk.ID] = tk
+	}
+	servants := make(map[string]tickets.Tickets)
+	for _, p := range sp {
+		tks := tickets.Tickets{}
+		for _, tk := range p.Tickets {
+			if latest, ok := catalogM[tk.ID]; ok {
+				tk = latest
+			}
+			tks = append(tks, tk)
+		}
+		servants[p.ServantID] = tks
+	}
+	return servants
+}
+
+func (m *Master) saveAssignment(sp ServantPayloads) error {
+	data, err := json.Marshal(newAssignment(m.ID, m.epoch, sp))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+	defer cancel()
+	return m.fencedPut(ctx, util.AssignmentKey(m.Prefix), string(data))
+}
+
+// LoadAssignment read the committed assignment from etcd, nil if not found
+func (m *Master) LoadAssignment() (*Assignment, error) {
+	resp, err := m.EtcdCli.Get(context.Background(), util.AssignmentKey(m.Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	a := new(Assignment)
+	if err = json.Unmarshal(resp.Kvs[0].Value, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// restoreAssignment start from the assignment committed by previous master
+func (m *Master) restoreAssignment() {
+	a, err := m.LoadAssignment()
+	if err != nil {
+		log.M(util.ModuleName).Warningf("load committed assignment fail:%v", err)
+		return
+	}
+	if a == nil {
+		return
+	}
+	var catalog tickets.Tickets
+	if m.TicketSource != nil {
+		if catalog, err = m.TicketSource.Tickets(); err != nil {
+			log.M(util.ModuleName).Warningf("load tickets fail:%v", err)
+		}
+	}
+	log.M(util.ModuleName).Infof("restore assignment committed by master %s epoch %d", a.MasterID, a.Epoch)
+	m.committed = a.Payloads(catalog)
+}
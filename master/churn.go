@@ -0,0 +1,95 @@
+package master
+
+import (
+	"sort"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// ChurnBudget limit how many tickets may move between servants in one dispatch round,
+// zero value fields mean no limit, the remaining imbalance is fixed over later rounds
+type ChurnBudget struct {
+	// max ticket moves per round
+	MaxMoves int
+	// max ticket moves per round in percent of all dispatched tickets, 0-100
+	MaxPercent float64
+}
+
+func (b ChurnBudget) limit(total int) int {
+	limit := -1
+	if b.MaxMoves > 0 {
+		limit = b.MaxMoves
+	}
+	if b.MaxPercent > 0 {
+		n := int(float64(total) * b.MaxPercent / 100)
+		if n == 0 {
+			n = 1
+		}
+		if limit < 0 || n < limit {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// LimitChurn wrap a DispatchHandler so it moves at most budget tickets per round,
+// moves beyond budget are reverted to the current owner of ticket
+func LimitChurn(h DispatchHandler, budget ChurnBudget) DispatchHandler {
+	return func(last *CurrentDispatch, newDis *NewDispatch) error {
+		// snapshot ownership before handler, which may modify last in place
+		oldOwners := ticketOwners(last.ServantPayloads)
+		if err := h(last, newDis); err != nil {
+			return err
+		}
+		applyChurnBudget(oldOwners, newDis, budget)
+		return nil
+	}
+}
+
+func ticketOwners(sp ServantPayloads) map[string]string {
+	owners := make(map[string]string)
+	for _, p := range sp {
+		for _, tk := range p.Tickets {
+			owners[tk.ID] = p.ServantID
+		}
+	}
+	return owners
+}
+
+func applyChurnBudget(oldOwners map[string]string, newDis *NewDispatch, budget ChurnBudget) {
+	idx := payloadIndex(newDis.ServantPayloads)
+	var total int
+	var moves []string
+	movedTickets := make(map[string]tickets.Ticket)
+	newOwners := make(map[string]string)
+	for _, p := range newDis.ServantPayloads {
+		total += len(p.Tickets)
+		for _, tk := range p.Tickets {
+			newOwners[tk.ID] = p.ServantID
+			old, ok := oldOwners[tk.ID]
+			if !ok || old == p.ServantID {
+				continue
+			}
+			// the old owner is leaving, nowhere to revert
+			if _, ok := idx[old]; !ok {
+				continue
+			}
+			moves = append(moves, tk.ID)
+			movedTickets[tk.ID] = tk
+		}
+	}
+	limit := budget.limit(total)
+	if limit < 0 || len(moves) <= limit {
+		return
+	}
+	sort.Strings(moves)
+	deferred := moves[limit:]
+	for _, id := range deferred {
+		from, to := &newDis.ServantPayloads[idx[newOwners[id]]], &newDis.ServantPayloads[idx[oldOwners[id]]]
+		from.Tickets = removeTicket(from.Tickets, id)
+		to.Tickets = appendTicket(to.Tickets, movedTickets[id])
+	}
+	log.M(util.ModuleName).Infof("churn budget %d reached, defer %d ticket moves to later rounds", limit, len(deferred))
+}
@@ -1,11 +1,17 @@
 package master
 
 import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+
 	"github.com/qjpcpu/servant-cluster/tickets"
 	"github.com/qjpcpu/servant-cluster/util"
-	"sort"
 )
 
+// DefaultHashReplicas is the virtual node count of each servant used by ConsistentHashDispatch
+const DefaultHashReplicas = 160
+
 func ConservativeAverageDispatch(tks tickets.Tickets, last *CurrentDispatch, newDis *NewDispatch) error {
 	ticketCount, servantCount := len(tks), len(last.ServantPayloads)
 	if servantCount == 0 {
@@ -68,3 +74,73 @@ func ConservativeAverageDispatch(tks tickets.Tickets, last *CurrentDispatch, new
 	newDis.ServantPayloads = (ServantPayloads)(newPayloads)
 	return nil
 }
+
+// ConsistentHashDispatch dispatch tickets by consistent hash, only about 1/N tickets move when a servant joins or leaves
+func ConsistentHashDispatch(tks tickets.Tickets, last *CurrentDispatch, newDis *NewDispatch) error {
+	return ConsistentHashDispatchWithReplicas(tks, DefaultHashReplicas, last, newDis)
+}
+
+// ConsistentHashDispatchWithReplicas same as ConsistentHashDispatch with replicas virtual nodes per servant
+func ConsistentHashDispatchWithReplicas(tks tickets.Tickets, replicas int, last *CurrentDispatch, newDis *NewDispatch) error {
+	if len(last.ServantPayloads) == 0 {
+		return nil
+	}
+	if replicas <= 0 {
+		replicas = DefaultHashReplicas
+	}
+	var servants []string
+	for _, p := range last.ServantPayloads {
+		servants = append(servants, p.ServantID)
+	}
+	ring := newHashRing(servants, replicas)
+	payloadM := make(map[string]tickets.Tickets)
+	for _, tk := range tks {
+		sid := ring.get(tk.ID)
+		payloadM[sid] = append(payloadM[sid], tk)
+	}
+	var newPayloads ServantPayloads
+	for _, sid := range servants {
+		list := payloadM[sid]
+		sort.Sort(list)
+		newPayloads = append(newPayloads, ServantPayload{
+			ServantID: sid,
+			Tickets:   list,
+		})
+	}
+	sort.Sort(newPayloads)
+	newDis.ServantPayloads = newPayloads
+	return nil
+}
+
+type hashRing struct {
+	hashes   []uint32
+	servants map[uint32]string
+}
+
+func newHashRing(servants []string, replicas int) *hashRing {
+	ring := &hashRing{servants: make(map[uint32]string)}
+	// sort servants so hash collision always resolves to the same servant
+	sorted := append([]string(nil), servants...)
+	sort.Strings(sorted)
+	for _, sid := range sorted {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + sid))
+			if _, ok := ring.servants[h]; ok {
+				continue
+			}
+			ring.servants[h] = sid
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+func (r *hashRing) get(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.servants[r.hashes[idx]]
+}
@@ -0,0 +1,220 @@
+package master
+
+import (
+	"sort"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// Constraint adjust a new dispatch to satisfy placement rules
+type Constraint interface {
+	Apply(last *CurrentDispatch, newDis *NewDispatch) error
+}
+
+// ConstraintFunc adapt a function to Constraint
+type ConstraintFunc func(*CurrentDispatch, *NewDispatch) error
+
+func (f ConstraintFunc) Apply(last *CurrentDispatch, newDis *NewDispatch) error {
+	return f(last, newDis)
+}
+
+// ApplyConstraints apply constraints to new dispatch in order
+func ApplyConstraints(last *CurrentDispatch, newDis *NewDispatch, cs ...Constraint) error {
+	for _, c := range cs {
+		if err := c.Apply(last, newDis); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithConstraints wrap a DispatchHandler so its result always satisfies constraints
+func WithConstraints(h DispatchHandler, cs ...Constraint) DispatchHandler {
+	return func(last *CurrentDispatch, newDis *NewDispatch) error {
+		if err := h(last, newDis); err != nil {
+			return err
+		}
+		return ApplyConstraints(last, newDis, cs...)
+	}
+}
+
+// CoLocation move all tickets of the same group to the servant holding most of them which accepts the whole group
+// by labels and capacity, groups no servant accepts are moved to NewDispatch.Unassigned
+func CoLocation() Constraint {
+	return ConstraintFunc(func(last *CurrentDispatch, newDis *NewDispatch) error {
+		servants := servantsOf(last)
+		groups := make(map[string]tickets.Tickets)
+		counts := make(map[string]map[string]int)
+		for _, p := range newDis.ServantPayloads {
+			for _, tk := range p.Tickets {
+				if tk.Group == "" {
+					continue
+				}
+				if counts[tk.Group] == nil {
+					counts[tk.Group] = make(map[string]int)
+				}
+				groups[tk.Group] = append(groups[tk.Group], tk)
+				counts[tk.Group][p.ServantID]++
+			}
+		}
+		var names []string
+		for group := range groups {
+			names = append(names, group)
+		}
+		sort.Strings(names)
+		for _, group := range names {
+			members, cnt := groups[group], counts[group]
+			var sids []string
+			for _, p := range newDis.ServantPayloads {
+				sids = append(sids, p.ServantID)
+			}
+			sort.Slice(sids, func(i, j int) bool {
+				if cnt[sids[i]] != cnt[sids[j]] {
+					return cnt[sids[i]] > cnt[sids[j]]
+				}
+				return sids[i] < sids[j]
+			})
+			idx := payloadIndex(newDis.ServantPayloads)
+			for i := range newDis.ServantPayloads {
+				p := &newDis.ServantPayloads[i]
+				var kept tickets.Tickets
+				for _, tk := range p.Tickets {
+					if tk.Group != group {
+						kept = append(kept, tk)
+					}
+				}
+				p.Tickets = kept
+			}
+			target := -1
+			for _, sid := range sids {
+				if p := newDis.ServantPayloads[idx[sid]]; canHold(servants[sid], p.Tickets, members) {
+					target = idx[sid]
+					break
+				}
+			}
+			if target < 0 {
+				log.M(util.ModuleName).Warningf("no servant accepts ticket group %s", group)
+				newDis.Unassigned = append(newDis.Unassigned, members...)
+				continue
+			}
+			dst := &newDis.ServantPayloads[target]
+			dst.Tickets = append(dst.Tickets[:len(dst.Tickets):len(dst.Tickets)], members...)
+		}
+		return nil
+	})
+}
+
+// AntiAffinity spread tickets sharing anti affinity key across different servants and hosts,
+// grouped tickets move with their group, servants with unmatched labels or no spare capacity are skipped,
+// tickets can not be spread are moved to NewDispatch.Unassigned
+func AntiAffinity() Constraint {
+	return ConstraintFunc(func(last *CurrentDispatch, newDis *NewDispatch) error {
+		servants := servantsOf(last)
+		keys := make(map[string]tickets.Tickets)
+		for _, p := range newDis.ServantPayloads {
+			for _, tk := range p.Tickets {
+				if tk.AntiAffinity != "" {
+					keys[tk.AntiAffinity] = append(keys[tk.AntiAffinity], tk)
+				}
+			}
+		}
+		var keyList []string
+		for key := range keys {
+			keyList = append(keyList, key)
+		}
+		sort.Strings(keyList)
+		idx := payloadIndex(newDis.ServantPayloads)
+		for _, key := range keyList {
+			list := keys[key]
+			sort.Sort(list)
+			owners := ticketOwners(newDis.ServantPayloads)
+			usedHosts := make(map[string]bool)
+			for _, tk := range list {
+				host := util.ServantHost(owners[tk.ID])
+				if !usedHosts[host] {
+					usedHosts[host] = true
+					continue
+				}
+				src := &newDis.ServantPayloads[idx[owners[tk.ID]]]
+				unit := tickets.Tickets{tk}
+				if tk.Group != "" {
+					unit = nil
+					for _, t := range src.Tickets {
+						if t.Group == tk.Group {
+							unit = append(unit, t)
+						}
+					}
+				}
+				dst := -1
+				for i, p := range newDis.ServantPayloads {
+					if usedHosts[util.ServantHost(p.ServantID)] || !canHold(servants[p.ServantID], p.Tickets, unit) {
+						continue
+					}
+					if dst == -1 || len(p.Tickets) < len(newDis.ServantPayloads[dst].Tickets) {
+						dst = i
+					}
+				}
+				if dst == -1 {
+					log.M(util.ModuleName).Warningf("no host left for ticket %s of anti affinity %s", tk.ID, key)
+					src.Tickets = removeTicket(src.Tickets, tk.ID)
+					newDis.Unassigned = append(newDis.Unassigned, tk)
+					continue
+				}
+				to := &newDis.ServantPayloads[dst]
+				for _, t := range unit {
+					src.Tickets = removeTicket(src.Tickets, t.ID)
+					to.Tickets = appendTicket(to.Tickets, t)
+					owners[t.ID] = to.ServantID
+				}
+				usedHosts[util.ServantHost(to.ServantID)] = true
+			}
+		}
+		return nil
+	})
+}
+
+// canHold report whether servant accepts tks on top of held by its labels and capacity
+func canHold(p ServantPayload, held, tks tickets.Tickets) bool {
+	for _, tk := range tks {
+		if !tk.MatchLabels(p.Labels) {
+			return false
+		}
+	}
+	c := ServantCapacity(p)
+	return c < 0 || len(held)+len(tks) <= c
+}
+
+// servantsOf index payloads of last dispatch by servant id
+func servantsOf(last *CurrentDispatch) map[string]ServantPayload {
+	servants := make(map[string]ServantPayload)
+	if last != nil {
+		for _, p := range last.ServantPayloads {
+			servants[p.ServantID] = p
+		}
+	}
+	return servants
+}
+
+func payloadIndex(sp ServantPayloads) map[string]int {
+	idx := make(map[string]int)
+	for i, p := range sp {
+		idx[p.ServantID] = i
+	}
+	return idx
+}
+
+func removeTicket(tks tickets.Tickets, id string) tickets.Tickets {
+	for i, tk := range tks {
+		if tk.ID == id {
+			return append(tks[:i:i], tks[i+1:]...)
+		}
+	}
+	return tks
+}
+
+// appendTicket never writes into backing array shared with other payloads
+func appendTicket(tks tickets.Tickets, tk tickets.Ticket) tickets.Tickets {
+	return append(tks[:len(tks):len(tks)], tk)
+}
@@ -0,0 +1,66 @@
+package master
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// DeadLetter is a ticket given up by servant after its retry attempts ran out
+type DeadLetter struct {
+	ServantID string
+	Status    tickets.TicketStatus
+}
+
+// DeadLetters collect dead lettered tickets from live servants, it stays dead lettered until master pushes tickets to its servant again
+func (m *Master) DeadLetters() ([]DeadLetter, error) {
+	m.round.Lock()
+	defer m.round.Unlock()
+	if m.sa == nil {
+		return nil, errors.New("master is not running")
+	}
+	servantList, err := m.sa.GetServants()
+	if err != nil {
+		return nil, err
+	}
+	var sids []string
+	for _, srvt := range servantList {
+		sids = append(sids, srvt.ID)
+	}
+	var letters []DeadLetter
+	for sid, state := range m.collectStates(sids, false) {
+		letters = append(letters, deadLetters(sid, state.States)...)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].ServantID != letters[j].ServantID {
+			return letters[i].ServantID < letters[j].ServantID
+		}
+		return letters[i].Status.ID < letters[j].Status.ID
+	})
+	return letters, nil
+}
+
+func deadLetters(sid string, states map[string]tickets.TicketStatus) []DeadLetter {
+	var letters []DeadLetter
+	for _, st := range states {
+		if st.State == tickets.TicketDeadLetter {
+			letters = append(letters, DeadLetter{ServantID: sid, Status: st})
+		}
+	}
+	return letters
+}
+
+// warnDeadLetters warn tickets newly dead lettered on servant, seen holds dead letters of last round
+// and dead letters of this round are added to current
+func warnDeadLetters(sid string, states map[string]tickets.TicketStatus, seen, current map[string]bool) {
+	for _, l := range deadLetters(sid, states) {
+		key := sid + "/" + l.Status.ID
+		if !seen[key] {
+			log.M(util.ModuleName).Warningf("ticket %s is dead lettered on servant %s after %d attempts:%s", l.Status.ID, sid, l.Status.Attempts, l.Status.Error)
+		}
+		current[key] = true
+	}
+}
@@ -0,0 +1,32 @@
+package master
+
+import (
+	"time"
+)
+
+// debounce collapse bursts of notifications from in into one notification to out,
+// it fires after window of quiet, or maxDelay after the first notification of a burst if maxDelay > 0
+func debounce(in <-chan struct{}, out chan<- struct{}, window, maxDelay time.Duration, closeC <-chan struct{}) {
+	go func() {
+		var quietC, deadlineC <-chan time.Time
+		for {
+			select {
+			case <-closeC:
+				return
+			case <-in:
+				if deadlineC == nil && maxDelay > 0 {
+					deadlineC = time.After(maxDelay)
+				}
+				quietC = time.After(window)
+				continue
+			case <-quietC:
+			case <-deadlineC:
+			}
+			quietC, deadlineC = nil, nil
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
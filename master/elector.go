@@ -0,0 +1,244 @@
+package master
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+)
+
+// DefaultElectionTTL is session ttl in seconds of EtcdElector
+const DefaultElectionTTL = 15
+
+// Elector elect one master among processes
+type Elector interface {
+	// Campaign block until id is elected or ctx is done, return fencing epoch which increases on every election
+	Campaign(ctx context.Context, id string) (int64, error)
+	// Lost is closed when leadership won by last Campaign is lost
+	Lost() <-chan struct{}
+	// Resign give up leadership
+	Resign(ctx context.Context) error
+	// Close resign and release elector
+	Close() error
+}
+
+var closedC = make(chan struct{})
+
+func init() {
+	close(closedC)
+}
+
+// EtcdElector elect master with etcd lease on the shared client,
+// the create revision of elected key is used as fencing epoch
+type EtcdElector struct {
+	cli   *clientv3.Client
+	key   string
+	ttl   int
+	mutex *sync.Mutex
+	// campaign in flight, the rpc is not made under mutex
+	campaigning bool
+	won         campaign
+	open        func() (campaign, error)
+}
+
+// campaign is one session and the election on it
+type campaign interface {
+	Campaign(ctx context.Context, val string) error
+	Rev() int64
+	Key() string
+	Resign(ctx context.Context) error
+	Done() <-chan struct{}
+	Close() error
+}
+
+type etcdCampaign struct {
+	*concurrency.Session
+	*concurrency.Election
+}
+
+// NewEtcdElector create elector campaigning under key, ttl is session ttl in seconds, 0 means DefaultElectionTTL
+func NewEtcdElector(cli *clientv3.Client, key string, ttl int) *EtcdElector {
+	if ttl <= 0 {
+		ttl = DefaultElectionTTL
+	}
+	e := &EtcdElector{cli: cli, key: key, ttl: ttl, mutex: new(sync.Mutex)}
+	e.open = func() (campaign, error) {
+		session, err := concurrency.NewSession(e.cli, concurrency.WithTTL(e.ttl))
+		if err != nil {
+			return nil, err
+		}
+		return &etcdCampaign{Session: session, Election: concurrency.NewElection(session, e.key)}, nil
+	}
+	return e
+}
+
+func (e *EtcdElector) Campaign(ctx context.Context, id string) (int64, error) {
+	e.mutex.Lock()
+	if e.won != nil {
+		select {
+		case <-e.won.Done():
+			// session expired, start over with a new one
+			e.won.Close()
+			e.won = nil
+		default:
+			e.mutex.Unlock()
+			return 0, errors.New("already campaigned")
+		}
+	}
+	if e.campaigning {
+		e.mutex.Unlock()
+		return 0, errors.New("campaign in progress")
+	}
+	e.campaigning = true
+	e.mutex.Unlock()
+
+	c, err := e.open()
+	if err == nil {
+		if err = c.Campaign(ctx, id); err != nil {
+			c.Close()
+		}
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.campaigning = false
+	if err != nil {
+		return 0, err
+	}
+	e.won = c
+	return c.Rev(), nil
+}
+
+func (e *EtcdElector) Lost() <-chan struct{} {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.won == nil {
+		return closedC
+	}
+	return e.won.Done()
+}
+
+// Key return the election key won by last Campaign, empty if not leading
+func (e *EtcdElector) Key() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.won == nil {
+		return ""
+	}
+	return e.won.Key()
+}
+
+func (e *EtcdElector) Resign(ctx context.Context) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.won == nil {
+		return nil
+	}
+	err := e.won.Resign(ctx)
+	// revoke lease so Lost fires and the key is gone even if resign fails
+	e.won.Close()
+	e.won = nil
+	return err
+}
+
+func (e *EtcdElector) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+	defer cancel()
+	return e.Resign(ctx)
+}
+
+// MemoryElection is an in process election for tests, electors created by it compete with each other
+type MemoryElection struct {
+	mutex    *sync.Mutex
+	leader   *memoryElector
+	rev      int64
+	changedC chan struct{}
+}
+
+func NewMemoryElection() *MemoryElection {
+	return &MemoryElection{mutex: new(sync.Mutex), changedC: make(chan struct{})}
+}
+
+// NewElector create an elector competing in this election
+func (me *MemoryElection) NewElector() Elector {
+	return &memoryElector{election: me}
+}
+
+// Leader return id of current leader, empty if none
+func (me *MemoryElection) Leader() string {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if me.leader == nil {
+		return ""
+	}
+	return me.leader.id
+}
+
+// Expire drop current leader as if its session expired
+func (me *MemoryElection) Expire() {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.release(me.leader)
+}
+
+func (me *MemoryElection) release(e *memoryElector) {
+	if e == nil || me.leader != e {
+		return
+	}
+	close(e.lostC)
+	me.leader = nil
+	close(me.changedC)
+	me.changedC = make(chan struct{})
+}
+
+type memoryElector struct {
+	election *MemoryElection
+	id       string
+	lostC    chan struct{}
+}
+
+func (e *memoryElector) Campaign(ctx context.Context, id string) (int64, error) {
+	me := e.election
+	for {
+		me.mutex.Lock()
+		if me.leader == e {
+			me.mutex.Unlock()
+			return 0, errors.New("already campaigned")
+		}
+		if me.leader == nil {
+			me.rev++
+			rev := me.rev
+			me.leader, e.id, e.lostC = e, id, make(chan struct{})
+			me.mutex.Unlock()
+			return rev, nil
+		}
+		changedC := me.changedC
+		me.mutex.Unlock()
+		select {
+		case <-changedC:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (e *memoryElector) Lost() <-chan struct{} {
+	e.election.mutex.Lock()
+	defer e.election.mutex.Unlock()
+	if e.lostC == nil {
+		return closedC
+	}
+	return e.lostC
+}
+
+func (e *memoryElector) Resign(ctx context.Context) error {
+	e.election.mutex.Lock()
+	defer e.election.mutex.Unlock()
+	e.election.release(e)
+	return nil
+}
+
+func (e *memoryElector) Close() error {
+	return e.Resign(context.Background())
+}
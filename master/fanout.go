@@ -0,0 +1,64 @@
+package master
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConcurrency = 16
+	defaultRPCTimeout  = 5 * time.Second
+	// wait before the first retry of a failed rpc call, doubled on every retry
+	defaultRPCRetryBackoff = 100 * time.Millisecond
+)
+
+// fanOut call fn for every servant in parallel with at most Concurrency calls in flight,
+// every call has its own RPCTimeout deadline and is retried RPCRetries times on failure with backoff,
+// return the last error of failed servants
+func (m *Master) fanOut(sids []string, fn func(ctx context.Context, sid string) error) map[string]error {
+	concurrency := m.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	timeout := m.RPCTimeout
+	if timeout <= 0 {
+		timeout = defaultRPCTimeout
+	}
+	backoff := m.RPCRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRPCRetryBackoff
+	}
+	errs := make(map[string]error)
+	mutex := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	sem := make(chan struct{}, concurrency)
+	for _, sid := range sids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(sid string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			var err error
+			for i := 0; ; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				err = fn(ctx, sid)
+				cancel()
+				if err == nil {
+					return
+				}
+				if i >= m.RPCRetries {
+					break
+				}
+				time.Sleep(backoff << uint(i))
+			}
+			mutex.Lock()
+			errs[sid] = err
+			mutex.Unlock()
+		}(sid)
+	}
+	wg.Wait()
+	return errs
+}
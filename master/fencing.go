@@ -0,0 +1,48 @@
+package master
+
+import (
+	"context"
+	"fmt"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+// checkFencing fail when servant has seen a newer master, no check before elected
+func (m *Master) checkFencing(sid string, state *servantState) error {
+	if m.epoch > 0 && state.Epoch > m.epoch {
+		return fmt.Errorf("servant %s has seen newer master %s epoch %d, current epoch %d", sid, state.MasterID, state.Epoch, m.epoch)
+	}
+	return nil
+}
+
+// fencedElector is an elector whose leadership is an etcd key
+type fencedElector interface {
+	// Key return the etcd key won by last Campaign, empty if not leading
+	Key() string
+}
+
+// fencedPut put key only while the election key created at current epoch is alive,
+// so a deposed master can not overwrite what its successor saved
+func (m *Master) fencedPut(ctx context.Context, key, val string) error {
+	return m.fencedTxn(ctx, clientv3.OpPut(key, val))
+}
+
+// fencedTxn commit ops only while the election key created at current epoch is alive
+func (m *Master) fencedTxn(ctx context.Context, ops ...clientv3.Op) error {
+	txn := m.EtcdCli.Txn(ctx)
+	if fe, ok := m.Elector.(fencedElector); ok {
+		ek := fe.Key()
+		if ek == "" {
+			return fmt.Errorf("master epoch %d is not leading, nothing saved", m.epoch)
+		}
+		txn = txn.If(clientv3.Compare(clientv3.CreateRevision(ek), "=", m.epoch))
+	}
+	resp, err := txn.Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("master epoch %d is fenced off, nothing saved", m.epoch)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package master
+
+import (
+	"time"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// interval of rounds retrying tickets withheld until their old owner confirms revocation
+const handoffRetryInterval = 1 * time.Second
+
+// revokeBeforeGrant revoke tickets moving to other servants from their current owners, tickets still running
+// on another servant are withheld from new owners and granted in a later round, return true if any is withheld
+func (m *Master) revokeBeforeGrant(current map[string]tickets.Tickets, newDis *NewDispatch) bool {
+	newOwners := ticketOwners(newDis.ServantPayloads)
+	granted := grantedTickets(current, newDis)
+	unconfirmed := make(map[string]bool)
+	revokes := make(map[string]tickets.Tickets)
+	movings := make(map[string]map[string]bool)
+	for sid, tks := range current {
+		var kept tickets.Tickets
+		moving := make(map[string]bool)
+		for _, tk := range tks {
+			owner, ok := newOwners[tk.ID]
+			if ok && owner == sid {
+				kept = append(kept, tk)
+			} else if ok {
+				moving[tk.ID] = true
+			}
+		}
+		if len(kept) == len(tks) {
+			continue
+		}
+		revokes[sid] = kept
+		movings[sid] = moving
+	}
+	errs := m.pushTickets(revokes)
+	for sid, kept := range revokes {
+		if err, ok := errs[sid]; ok {
+			log.M(util.ModuleName).Warningf("revoke %s tickets fail:%v", sid, err)
+			for id := range movings[sid] {
+				unconfirmed[id] = true
+			}
+			continue
+		}
+		log.M(util.ModuleName).Debugf("revoke %s tickets, remain %s", sid, kept.Summary())
+		current[sid] = kept
+	}
+	if len(granted) > 0 {
+		// revoked tickets and tickets withheld in former rounds are no longer listed by their old owner,
+		// but may still be running there
+		sids := make(map[string]bool)
+		for sid := range current {
+			sids[sid] = true
+		}
+		for _, p := range newDis.ServantPayloads {
+			sids[p.ServantID] = true
+		}
+		var list []string
+		for sid := range sids {
+			list = append(list, sid)
+		}
+		for id, sid := range runningElsewhere(granted, m.collectStates(list, true)) {
+			log.M(util.ModuleName).Infof("ticket %s is still running on servant %s, withhold it", id, sid)
+			unconfirmed[id] = true
+		}
+	}
+	withholdTickets(newDis, unconfirmed)
+	return len(unconfirmed) > 0
+}
+
+// grantedTickets return ticket id to new owner for tickets not held by their new owner yet
+func grantedTickets(current map[string]tickets.Tickets, newDis *NewDispatch) map[string]string {
+	granted := make(map[string]string)
+	for _, p := range newDis.ServantPayloads {
+		held := make(map[string]bool)
+		for _, tk := range current[p.ServantID] {
+			held[tk.ID] = true
+		}
+		for _, tk := range p.Tickets {
+			if !held[tk.ID] {
+				granted[tk.ID] = p.ServantID
+			}
+		}
+	}
+	return granted
+}
+
+// runningElsewhere return ticket id to servant for granted tickets whose handler is running on another servant
+func runningElsewhere(granted map[string]string, states map[string]*servantState) map[string]string {
+	running := make(map[string]string)
+	for sid, state := range states {
+		for _, id := range state.Running {
+			if owner, ok := granted[id]; ok && owner != sid {
+				running[id] = sid
+			}
+		}
+	}
+	return running
+}
+
+// orphanTickets return tickets dispatched but held by none of servants in current
+func orphanTickets(current map[string]tickets.Tickets, newDis *NewDispatch) map[string]bool {
+	held := make(map[string]bool)
+	for _, tks := range current {
+		for _, tk := range tks {
+			held[tk.ID] = true
+		}
+	}
+	orphans := make(map[string]bool)
+	for _, p := range newDis.ServantPayloads {
+		for _, tk := range p.Tickets {
+			if !held[tk.ID] {
+				orphans[tk.ID] = true
+			}
+		}
+	}
+	return orphans
+}
+
+// withholdTickets move unconfirmed tickets to unassigned until next round
+func withholdTickets(newDis *NewDispatch, unconfirmed map[string]bool) {
+	if len(unconfirmed) == 0 {
+		return
+	}
+	for i := range newDis.ServantPayloads {
+		p := &newDis.ServantPayloads[i]
+		var tks tickets.Tickets
+		for _, tk := range p.Tickets {
+			if unconfirmed[tk.ID] {
+				newDis.Unassigned = append(newDis.Unassigned, tk)
+			} else {
+				tks = append(tks, tk)
+			}
+		}
+		p.Tickets = tks
+	}
+}
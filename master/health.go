@@ -0,0 +1,76 @@
+package master
+
+import (
+	"time"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// DefaultUnhealthyThreshold is consecutive failed rpc calls marking a servant unhealthy
+const DefaultUnhealthyThreshold = 3
+
+// ServantHealth is rpc health of a servant observed by master
+type ServantHealth struct {
+	// false once consecutive failures reach the unhealthy threshold, until a call succeeds
+	Healthy bool
+	// consecutive failed rpc calls
+	Failures int
+	// latency of last successful rpc call
+	Latency time.Duration
+	// error of last failed rpc call
+	LastError error
+	// servant just recovered from unhealthy and tickets it reports are stale
+	Recovered bool
+}
+
+// observe record result of a rpc call to servant
+func (wa *servantAccessor) observe(wid string, start time.Time, err error) {
+	wa.healthMutex.Lock()
+	defer wa.healthMutex.Unlock()
+	h, ok := wa.health[wid]
+	if !ok {
+		h = &ServantHealth{Healthy: true}
+		wa.health[wid] = h
+	}
+	if err != nil {
+		h.Failures++
+		h.LastError = err
+		if h.Healthy && h.Failures >= wa.unhealthyThreshold {
+			h.Healthy = false
+			log.M(util.ModuleName).Warningf("servant %s is unhealthy after %d failures:%v", wid, h.Failures, err)
+		}
+		return
+	}
+	if !h.Healthy {
+		h.Recovered = true
+		log.M(util.ModuleName).Infof("servant %s recovered", wid)
+	}
+	h.Healthy, h.Failures, h.LastError = true, 0, nil
+	h.Latency = time.Since(start)
+}
+
+// Health return health of servant, servant never called is healthy
+func (wa *servantAccessor) Health(wid string) ServantHealth {
+	wa.healthMutex.Lock()
+	defer wa.healthMutex.Unlock()
+	if h, ok := wa.health[wid]; ok {
+		return *h
+	}
+	return ServantHealth{Healthy: true}
+}
+
+// settle mark tickets of a recovered servant in sync again after master pushes to it
+func (wa *servantAccessor) settle(wid string) {
+	wa.healthMutex.Lock()
+	defer wa.healthMutex.Unlock()
+	if h, ok := wa.health[wid]; ok {
+		h.Recovered = false
+	}
+}
+
+func (wa *servantAccessor) forget(wid string) {
+	wa.healthMutex.Lock()
+	defer wa.healthMutex.Unlock()
+	delete(wa.health, wid)
+}
@@ -0,0 +1,174 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/util"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// DefaultHistoryLimit is max dispatch records kept in etcd
+const DefaultHistoryLimit = 1000
+
+// Trigger is what starts a dispatch round
+type Trigger string
+
+const (
+	// first round after elected
+	TriggerElection Trigger = "election"
+	// ScheduleInterval elapsed
+	TriggerInterval Trigger = "interval"
+	// servant joined or left
+	TriggerMembership Trigger = "membership"
+	// servant requested reschedule
+	TriggerManual Trigger = "manual"
+	// ticket catalog changed
+	TriggerTickets Trigger = "tickets"
+	// tickets withheld for revocation are retried
+	TriggerHandoff Trigger = "handoff"
+)
+
+// DispatchRecord is one committed dispatch round
+type DispatchRecord struct {
+	Time     time.Time `json:"time"`
+	MasterID string    `json:"master_id"`
+	Epoch    int64     `json:"epoch"`
+	Triggers []Trigger `json:"triggers"`
+	// servants whose tickets changed
+	Changes []ServantChange `json:"changes"`
+	// ticket ids left out by dispatch
+	Unassigned []string `json:"unassigned,omitempty"`
+}
+
+// ServantChange is ticket ids added to and removed from a servant
+type ServantChange struct {
+	ServantID string   `json:"servant_id"`
+	Added     []string `json:"added,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+}
+
+// pendingTriggers collect triggers of changes until next round
+type pendingTriggers struct {
+	mutex sync.Mutex
+	kinds map[Trigger]bool
+}
+
+func (pt *pendingTriggers) add(t Trigger) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	if pt.kinds == nil {
+		pt.kinds = make(map[Trigger]bool)
+	}
+	pt.kinds[t] = true
+}
+
+func (pt *pendingTriggers) take() []Trigger {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	var ts []Trigger
+	for t := range pt.kinds {
+		ts = append(ts, t)
+	}
+	pt.kinds = nil
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	return ts
+}
+
+// forwardTrigger record trigger of every change from in and pass it to out
+func (m *Master) forwardTrigger(t Trigger, in <-chan struct{}, out chan<- struct{}) {
+	go func() {
+		for {
+			select {
+			case <-in:
+				m.triggers.add(t)
+				select {
+				case out <- struct{}{}:
+				default:
+				}
+			case <-m.closeC:
+				return
+			}
+		}
+	}()
+}
+
+// newDispatchRecord record changes of plan, servants failed to push are left out as their tickets did not change
+func newDispatchRecord(masterID string, epoch int64, triggers []Trigger, plan *DispatchPlan, failed map[string]error) *DispatchRecord {
+	r := &DispatchRecord{Time: time.Now(), MasterID: masterID, Epoch: epoch, Triggers: triggers}
+	for _, s := range plan.Servants {
+		if _, ok := failed[s.ServantID]; ok || !s.Changed() {
+			continue
+		}
+		c := ServantChange{ServantID: s.ServantID}
+		for _, tk := range s.Added {
+			c.Added = append(c.Added, tk.ID)
+		}
+		for _, tk := range s.Removed {
+			c.Removed = append(c.Removed, tk.ID)
+		}
+		r.Changes = append(r.Changes, c)
+	}
+	for _, tk := range plan.Unassigned {
+		r.Unassigned = append(r.Unassigned, tk.ID)
+	}
+	return r
+}
+
+// saveHistory append record and drop the oldest ones beyond HistoryLimit in one fenced txn
+func (m *Master) saveHistory(r *DispatchRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	key := util.HistoryKey(m.Prefix) + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+	defer cancel()
+	ops := []clientv3.Op{clientv3.OpPut(fmt.Sprintf("%s%020d", key, r.Time.UnixNano()), string(data))}
+	limit := m.HistoryLimit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	resp, err := m.EtcdCli.Get(ctx, key, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+	if over := resp.Count + 1 - int64(limit); over > 0 {
+		resp, err = m.EtcdCli.Get(ctx, key, clientv3.WithPrefix(), clientv3.WithKeysOnly(),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend), clientv3.WithLimit(over))
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+		}
+	}
+	return m.fencedTxn(ctx, ops...)
+}
+
+// DispatchHistory return at most limit dispatch records, newest first, limit <= 0 means all kept records
+func (m *Master) DispatchHistory(limit int) ([]DispatchRecord, error) {
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend)}
+	if limit > 0 {
+		opts = append(opts, clientv3.WithLimit(int64(limit)))
+	}
+	resp, err := m.EtcdCli.Get(context.Background(), util.HistoryKey(m.Prefix)+"/", opts...)
+	if err != nil {
+		return nil, err
+	}
+	var records []DispatchRecord
+	for _, kv := range resp.Kvs {
+		var r DispatchRecord
+		if err = json.Unmarshal(kv.Value, &r); err != nil {
+			log.M(util.ModuleName).Warningf("bad dispatch record %s:%v", kv.Key, err)
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
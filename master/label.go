@@ -0,0 +1,73 @@
+package master
+
+import (
+	"sort"
+
+	"github.com/qjpcpu/servant-cluster/tickets"
+)
+
+// LabelAffinityDispatch only place a ticket on servants whose labels match the ticket required labels,
+// tickets without any matching servant are reported in NewDispatch.Unassigned
+func LabelAffinityDispatch(tks tickets.Tickets, last *CurrentDispatch, newDis *NewDispatch) error {
+	if len(last.ServantPayloads) == 0 {
+		return nil
+	}
+	payloads := make(ServantPayloads, len(last.ServantPayloads))
+	copy(payloads, last.ServantPayloads)
+	sort.Sort(payloads)
+	average := (len(tks) + len(payloads) - 1) / len(payloads)
+
+	ticketMap := make(map[string]tickets.Ticket)
+	for _, tk := range tks {
+		ticketMap[tk.ID] = tk
+	}
+	newPayloads := make(ServantPayloads, len(payloads))
+	for i, lastp := range payloads {
+		newPayloads[i].ServantID = lastp.ServantID
+		newPayloads[i].Labels = lastp.Labels
+		// keep tickets still matching servant labels
+		for _, tk := range lastp.Tickets {
+			if len(newPayloads[i].Tickets) >= average {
+				break
+			}
+			if nt, ok := ticketMap[tk.ID]; ok && nt.MatchLabels(lastp.Labels) {
+				newPayloads[i].Tickets = append(newPayloads[i].Tickets, nt)
+				delete(ticketMap, tk.ID)
+			}
+		}
+	}
+
+	// place the most constrained tickets first
+	var remainTickets tickets.Tickets
+	candidates := make(map[string][]int)
+	for _, tk := range ticketMap {
+		for i, p := range newPayloads {
+			if tk.MatchLabels(p.Labels) {
+				candidates[tk.ID] = append(candidates[tk.ID], i)
+			}
+		}
+		remainTickets = append(remainTickets, tk)
+	}
+	sort.Slice(remainTickets, func(i, j int) bool {
+		ci, cj := len(candidates[remainTickets[i].ID]), len(candidates[remainTickets[j].ID])
+		if ci != cj {
+			return ci < cj
+		}
+		return remainTickets[i].ID < remainTickets[j].ID
+	})
+	for _, tk := range remainTickets {
+		idx := -1
+		for _, i := range candidates[tk.ID] {
+			if idx == -1 || len(newPayloads[i].Tickets) < len(newPayloads[idx].Tickets) {
+				idx = i
+			}
+		}
+		if idx == -1 {
+			newDis.Unassigned = append(newDis.Unassigned, tk)
+			continue
+		}
+		newPayloads[idx].Tickets = append(newPayloads[idx].Tickets, tk)
+	}
+	newDis.ServantPayloads = newPayloads
+	return nil
+}
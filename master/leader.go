@@ -0,0 +1,85 @@
+package master
+
+import (
+	"context"
+	"sync"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// LeaderTask runs only while this process is master, ctx is cancelled on demotion or stop
+type LeaderTask func(ctx context.Context) error
+
+type leaderTasks struct {
+	mutex  sync.Mutex
+	tasks  []LeaderTask
+	leader bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// RunAsLeader register a task running only while this process is master,
+// it is started at once if this process is master now
+func (m *Master) RunAsLeader(task LeaderTask) {
+	m.leaderTasks.mutex.Lock()
+	defer m.leaderTasks.mutex.Unlock()
+	m.leaderTasks.tasks = append(m.leaderTasks.tasks, task)
+	if m.leaderTasks.leader {
+		m.startLeaderTask(task)
+	}
+}
+
+// IsLeader report whether this process is master now
+func (m *Master) IsLeader() bool {
+	m.leaderTasks.mutex.Lock()
+	defer m.leaderTasks.mutex.Unlock()
+	return m.leaderTasks.leader
+}
+
+func (m *Master) becomeLeader() {
+	lt := &m.leaderTasks
+	lt.mutex.Lock()
+	if lt.leader {
+		lt.mutex.Unlock()
+		return
+	}
+	lt.leader = true
+	lt.ctx, lt.cancel = context.WithCancel(context.Background())
+	for _, task := range lt.tasks {
+		m.startLeaderTask(task)
+	}
+	lt.mutex.Unlock()
+	if m.OnBecomeLeader != nil {
+		m.OnBecomeLeader()
+	}
+}
+
+// loseLeadership cancel leader tasks and wait them exit
+func (m *Master) loseLeadership() {
+	lt := &m.leaderTasks
+	lt.mutex.Lock()
+	if !lt.leader {
+		lt.mutex.Unlock()
+		return
+	}
+	lt.leader = false
+	lt.cancel()
+	lt.mutex.Unlock()
+	lt.wg.Wait()
+	if m.OnLoseLeadership != nil {
+		m.OnLoseLeadership()
+	}
+}
+
+func (m *Master) startLeaderTask(task LeaderTask) {
+	lt := &m.leaderTasks
+	lt.wg.Add(1)
+	go func(ctx context.Context) {
+		defer lt.wg.Done()
+		if err := task(ctx); err != nil && ctx.Err() == nil {
+			log.M(util.ModuleName).Errorf("leader task fail:%v", err)
+		}
+	}(lt.ctx)
+}
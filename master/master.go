@@ -1,11 +1,11 @@
 package master
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
 
-	"github.com/qjpcpu/common/election"
 	"github.com/qjpcpu/log"
 	"github.com/qjpcpu/servant-cluster/tickets"
 	"github.com/qjpcpu/servant-cluster/util"
@@ -13,20 +13,74 @@ import (
 )
 
 type Master struct {
-	HaEtcdEndpoints  []string
+	// Deprecated: ignored, election runs on EtcdCli or Elector
+	HaEtcdEndpoints []string
+	// identity of master attached to tickets pushed to servants
+	ID               string
 	Prefix           string
 	ScheduleInterval time.Duration
 	DispatchHandler  DispatchHandler
-	EtcdCli          *clientv3.Client
+	// DispatchStrategy takes precedence over DispatchHandler
+	DispatchStrategy DispatchStrategy
+	// full ticket catalog for DispatchStrategy, catalog changes trigger dispatch
+	TicketSource TicketSource
+	EtcdCli      *clientv3.Client
+	// master election, default is EtcdElector on EtcdCli
+	Elector Elector
+	// session ttl in seconds of default Elector, default 15
+	ElectionTTL int
+	// revoke moving tickets from old owner and grant them to new owner in a later round after its running
+	// handlers finish, tickets of unhealthy servant stay unassigned until it recovers or its lease is gone
+	ExclusiveHandoff bool
+	// max time tickets withheld for revocation are retried in quick rounds, after that they are retried
+	// every ScheduleInterval, default 30s
+	HandoffTimeout time.Duration
+	// max parallel rpc calls to servants, default 16
+	Concurrency int
+	// deadline of every rpc call to servant, default 5s
+	RPCTimeout time.Duration
+	// retry times of failed rpc call to servant in one round
+	RPCRetries int
+	// wait before retrying failed rpc call, doubled on every retry, default 100ms
+	RPCRetryBackoff time.Duration
+	// tickets not started by any worker of servant within AckTimeout are moved to another servant, 0 disables,
+	// add UnackedMiddleware inside constraint and churn middlewares to have the moves checked and counted
+	AckTimeout time.Duration
+	// consecutive failed rpc calls marking servant unhealthy, unhealthy servant is kept out of dispatch
+	// until it recovers, default 3
+	UnhealthyThreshold int
+	// collapse bursts of servant and ticket changes into one dispatch round after this quiet window, 0 disables
+	TriggerDebounce time.Duration
+	// max delay of a dispatch round since the first change of a burst, 0 means no limit
+	TriggerMaxDelay time.Duration
+	// max dispatch records kept in etcd, default 1000
+	HistoryLimit int
+	// called when this process becomes master
+	OnBecomeLeader func()
+	// called when this process is no longer master, after leader tasks exit
+	OnLoseLeadership func()
 
-	ha     *election.HA
-	sa     *servantAccessor
-	closeC chan struct{}
-	wg     *sync.WaitGroup
+	leaderTasks leaderTasks
+	triggers    pendingTriggers
+	sa          *servantAccessor
+	committed   ServantPayloads
+	// serialize dispatch rounds with dry runs of Plan
+	round sync.Mutex
+	// dead letters warned in last round
+	letters map[string]bool
+	// since when tickets are withheld for revocation, zero if none
+	handoffSince time.Time
+	// unix nano until which resigned master stays out of election
+	holdoffUntil int64
+	// mod revision of successor hint deferred to
+	deferredRev int64
+	epoch       int64
+	closeC      chan struct{}
+	wg          *sync.WaitGroup
 }
 
 func (m *Master) Run() error {
-	if m.DispatchHandler == nil || m.EtcdCli == nil || len(m.HaEtcdEndpoints) == 0 {
+	if (m.DispatchHandler == nil && m.DispatchStrategy == nil) || m.EtcdCli == nil {
 		return errors.New("bad master config")
 	}
 	if m.wg == nil {
@@ -35,91 +89,189 @@ func (m *Master) Run() error {
 	m.wg.Add(1)
 	defer m.wg.Done()
 	m.closeC = make(chan struct{})
-	ha := election.New(m.HaEtcdEndpoints, util.MasterKey(m.Prefix)).TTL(15)
-	m.ha = ha
-	m.sa = newServantAccessor(m.EtcdCli, util.ServantKey(m.Prefix))
-	servantsC := make(chan struct{})
+	if m.Elector == nil {
+		m.Elector = NewEtcdElector(m.EtcdCli, util.MasterKey(m.Prefix), m.ElectionTTL)
+	}
+	m.round.Lock()
+	m.sa = newServantAccessor(m.EtcdCli, util.ServantKey(m.Prefix), m.UnhealthyThreshold)
+	m.round.Unlock()
+	if m.ScheduleInterval == 0 {
+		m.ScheduleInterval = 1 * time.Minute
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.closeC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	// buffered so changes during a round are not lost
+	servantsC := make(chan struct{}, 1)
 
-	go ha.Start()
-	if !ha.IsLeader() {
+	var watching bool
+	for {
+		if !m.waitHoldoff() {
+			return nil
+		}
 		log.M(util.ModuleName).Info("Trying to be master")
-	CAMPAIGN:
-		for {
+		epoch, err := m.Elector.Campaign(ctx, m.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.M(util.ModuleName).Errorf("campaign fail:%v", err)
 			select {
-			case role := <-ha.RoleC():
-				if role == election.Leader {
-					break CAMPAIGN
-				}
+			case <-time.After(time.Second):
+				continue
 			case <-m.closeC:
 				return nil
 			}
 		}
+		if m.deferToSuccessor() {
+			continue
+		}
+		log.M(util.ModuleName).Infof("I am master now, epoch %d", epoch)
+		// new term of leadership
+		m.round.Lock()
+		m.epoch = epoch
+		m.sa.setFencing(m.ID, epoch)
+		m.restoreAssignment()
+		m.round.Unlock()
+		if !watching {
+			watching = true
+			changeC := servantsC
+			if m.TriggerDebounce > 0 {
+				changeC = make(chan struct{}, 1)
+				debounce(changeC, servantsC, m.TriggerDebounce, m.TriggerMaxDelay, m.closeC)
+			}
+			membershipC, manualC := make(chan struct{}, 1), make(chan struct{}, 1)
+			m.forwardTrigger(TriggerMembership, membershipC, changeC)
+			m.forwardTrigger(TriggerManual, manualC, changeC)
+			m.sa.watch(membershipC, manualC, m.closeC)
+			if m.TicketSource != nil {
+				ticketsC := make(chan struct{}, 1)
+				m.forwardTrigger(TriggerTickets, ticketsC, changeC)
+				if err := m.TicketSource.Watch(ticketsC, m.closeC); err != nil {
+					log.M(util.ModuleName).Errorf("watch tickets fail:%v", err)
+				}
+			}
+		}
+		m.becomeLeader()
+		stopped := m.lead(servantsC)
+		m.loseLeadership()
+		m.round.Lock()
+		m.epoch = 0
+		m.round.Unlock()
+		if stopped {
+			return nil
+		}
+		// release expired session so the next campaign starts over
+		rctx, rcancel := context.WithTimeout(ctx, defaultRPCTimeout)
+		if err = m.Elector.Resign(rctx); err != nil {
+			log.M(util.ModuleName).Warningf("resign master fail:%v", err)
+		}
+		rcancel()
+		log.M(util.ModuleName).Info("Switch to candidate, pause dispatching")
 	}
-	if m.ScheduleInterval == 0 {
-		m.ScheduleInterval = 1 * time.Minute
-	}
-	log.M(util.ModuleName).Info("I am master now.")
-	m.sa.watch(servantsC, m.closeC)
+}
+
+// lead dispatch until leadership is lost or master is stopped, return true if stopped
+func (m *Master) lead(triggerC <-chan struct{}) bool {
+	lostC := m.Elector.Lost()
+	// changes before election are covered by the first round
+	m.triggers.take()
+	triggers := []Trigger{TriggerElection}
 	for {
-		if err := m.loopOnce(); err != nil {
+		select {
+		case <-lostC:
+			return false
+		default:
+		}
+		if err := m.loopOnce(triggers); err != nil {
 			log.M(util.ModuleName).Errorf("dispatch fail:%v", err)
 		}
+		wait, next := m.ScheduleInterval, TriggerInterval
+		if m.handoffPending() {
+			wait, next = handoffRetryInterval, TriggerHandoff
+		}
 		select {
-		case role := <-ha.RoleC():
-			if role == election.Leader {
-				log.M(util.ModuleName).Info("I am master now, restart dispatching")
-			} else {
-				log.M(util.ModuleName).Info("Switch to candidate, pause dispatching")
-				for {
-					role2 := <-ha.RoleC()
-					if role2 == election.Leader {
-						break
-					}
-				}
-			}
-		case <-time.After(m.ScheduleInterval):
-		case <-servantsC:
+		case <-lostC:
+			return false
+		case <-time.After(wait):
+			triggers = []Trigger{next}
+		case <-triggerC:
+			triggers = m.triggers.take()
 		case <-m.closeC:
-			return nil
+			return true
 		}
 	}
 }
 
+// handoffPending return true if tickets withheld for revocation are still within HandoffTimeout
+func (m *Master) handoffPending() bool {
+	if m.handoffSince.IsZero() {
+		return false
+	}
+	timeout := m.HandoffTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	if time.Since(m.handoffSince) < timeout {
+		return true
+	}
+	log.M(util.ModuleName).Warningf("tickets withheld for revocation over %v, retry every %v", timeout, m.ScheduleInterval)
+	return false
+}
+
+func (m *Master) strategy() DispatchStrategy {
+	s := m.DispatchStrategy
+	if s == nil {
+		s = HandlerStrategy(m.DispatchHandler)
+	}
+	if m.AckTimeout > 0 {
+		// tickets already moved by UnackedMiddleware inside the chain are left alone
+		s = Chain(s, UnackedMiddleware())
+	}
+	return s
+}
+
 func (m *Master) Stop() {
 	close(m.closeC)
-	m.ha.Stop()
 	m.wg.Wait()
+	if m.Elector != nil {
+		if err := m.Elector.Close(); err != nil {
+			log.M(util.ModuleName).Warningf("resign master fail:%v", err)
+		}
+	}
+	if m.sa != nil {
+		m.sa.Close()
+	}
 	log.M(util.ModuleName).Info("master goroutine exit.")
 }
 
-func (m *Master) loopOnce() error {
-	servantList, err := m.sa.GetServants()
+func (m *Master) loopOnce(triggers []Trigger) error {
+	m.round.Lock()
+	defer m.round.Unlock()
+	servantTicketsM, newDis, err := m.dispatchOnce(false)
 	if err != nil {
-		log.M(util.ModuleName).Errorf("get servants fail:%v", err)
 		return err
 	}
-	servantTicketsM := make(map[string]tickets.Tickets)
-	var old ServantPayloads
-	for _, srvt := range servantList {
-		tks, stats, err := m.sa.GetServantTickets(srvt)
-		if err != nil {
-			log.M(util.ModuleName).Errorf("get servant %s tickets fail:%v", srvt, err)
-			return err
-		}
-		servantTicketsM[srvt] = tks
-		old = append(old, ServantPayload{
-			ServantID:   srvt,
-			Tickets:     tks,
-			SystemStats: stats,
-		})
+	// tickets held before this round, handoff revokes from servantTicketsM in place
+	held := make(map[string]tickets.Tickets)
+	for sid, tks := range servantTicketsM {
+		held[sid] = tks
 	}
-
-	// dispatch
-	var newDis NewDispatch
-	if err := m.DispatchHandler(&CurrentDispatch{ServantPayloads: old}, &newDis); err != nil {
-		log.M(util.ModuleName).Errorf("dispatch fail:%v", err)
-		return err
+	if m.ExclusiveHandoff && m.revokeBeforeGrant(servantTicketsM, newDis) {
+		if m.handoffSince.IsZero() {
+			m.handoffSince = time.Now()
+		}
+	} else {
+		m.handoffSince = time.Time{}
 	}
+	plan := diffDispatch(held, newDis)
+	pushes := make(map[string]tickets.Tickets)
 	for _, p := range newDis.ServantPayloads {
 		if ot, ok := servantTicketsM[p.ServantID]; ok && ot.Equals(p.Tickets) && !newDis.ForceFlush {
 			log.M(util.ModuleName).Debugf("remain %s %d tickets: %s", p.ServantID, len(p.Tickets), p.Tickets.Summary())
@@ -127,15 +279,189 @@ func (m *Master) loopOnce() error {
 			continue
 		}
 		delete(servantTicketsM, p.ServantID)
-		if err = m.sa.SetServantTickets(p.ServantID, p.Tickets); err != nil {
-			log.M(util.ModuleName).Warningf("dispatch %s tickets fail:%v", p.ServantID, err)
-		} else {
-			log.M(util.ModuleName).Debugf("dispatch %s %d tickets: %s", p.ServantID, len(p.Tickets), p.Tickets.Summary())
-		}
+		pushes[p.ServantID] = p.Tickets
 	}
 	for sid := range servantTicketsM {
-		m.sa.SetServantTickets(sid, nil)
+		pushes[sid] = nil
 		log.M(util.ModuleName).Warningf("clear %s tickets", sid)
 	}
+	errs := m.pushTickets(pushes)
+	record := newDispatchRecord(m.ID, m.epoch, triggers, plan, errs)
+	for sid, tks := range pushes {
+		if err, ok := errs[sid]; ok {
+			log.M(util.ModuleName).Warningf("dispatch %s tickets fail:%v", sid, err)
+		} else {
+			log.M(util.ModuleName).Debugf("dispatch %s %d tickets: %s", sid, len(tks), tks.Summary())
+		}
+	}
+	for _, p := range newDis.ServantPayloads {
+		if _, ok := errs[p.ServantID]; !ok {
+			m.sa.settle(p.ServantID)
+		}
+	}
+	m.committed = newDis.ServantPayloads
+	if err = m.saveAssignment(m.committed); err != nil {
+		log.M(util.ModuleName).Warningf("save assignment fail:%v", err)
+	}
+	if err = m.saveHistory(record); err != nil {
+		log.M(util.ModuleName).Warningf("save dispatch history fail:%v", err)
+	}
 	return nil
 }
+
+// pushTickets set tickets of servants in parallel
+func (m *Master) pushTickets(pushes map[string]tickets.Tickets) map[string]error {
+	var sids []string
+	for sid := range pushes {
+		sids = append(sids, sid)
+	}
+	return m.fanOut(sids, func(ctx context.Context, sid string) error {
+		return m.sa.SetServantTickets(ctx, sid, pushes[sid])
+	})
+}
+
+// collectStates fetch states of servants in parallel, failed servants are absent in result,
+// servant health is only updated if observe
+func (m *Master) collectStates(sids []string, observe bool) map[string]*servantState {
+	states := make(map[string]*servantState)
+	mutex := new(sync.Mutex)
+	errs := m.fanOut(sids, func(ctx context.Context, sid string) error {
+		get := m.sa.PeekServantTickets
+		if observe {
+			get = m.sa.GetServantTickets
+		}
+		state, err := get(ctx, sid)
+		if err != nil {
+			return err
+		}
+		mutex.Lock()
+		states[sid] = state
+		mutex.Unlock()
+		return nil
+	})
+	for sid, err := range errs {
+		log.M(util.ModuleName).Warningf("get servant %s tickets fail:%v", sid, err)
+	}
+	return states
+}
+
+// dispatchOnce collect current cluster state and run DispatchHandler against it,
+// return tickets currently held by each servant and the new dispatch,
+// servants failing to report are assumed holding committed tickets, or excluded from this round if unknown or unhealthy,
+// tickets held by no known servant are withheld while an excluded servant may hold them,
+// dry run leaves servant health and master state untouched
+func (m *Master) dispatchOnce(dryRun bool) (map[string]tickets.Tickets, *NewDispatch, error) {
+	servantList, err := m.sa.GetServants()
+	if err != nil {
+		log.M(util.ModuleName).Errorf("get servants fail:%v", err)
+		return nil, nil, err
+	}
+	var catalog tickets.Tickets
+	if m.TicketSource != nil {
+		if catalog, err = m.TicketSource.Tickets(); err != nil {
+			log.M(util.ModuleName).Errorf("load tickets fail:%v", err)
+			return nil, nil, err
+		}
+	}
+	committed := refreshTickets(m.committed, catalog)
+	var sids []string
+	for _, srvt := range servantList {
+		sids = append(sids, srvt.ID)
+	}
+	states := m.collectStates(sids, !dryRun)
+	servantTicketsM := make(map[string]tickets.Tickets)
+	health := make(map[string]ServantHealth)
+	stale := make(map[string]string)
+	var old ServantPayloads
+	// some servant may hold tickets nobody knows about
+	var unknown bool
+	// tickets of quarantined servants under exclusive handoff
+	quarantined := make(map[string]bool)
+	// dead letters seen in this round, keyed by servant and ticket id
+	letters := make(map[string]bool)
+	for _, srvt := range servantList {
+		h := m.sa.Health(srvt.ID)
+		health[srvt.ID] = h
+		state, ok := states[srvt.ID]
+		held := state
+		if ok && h.Recovered {
+			// tickets held before quarantine have been dispatched to others
+			log.M(util.ModuleName).Infof("servant %s recovered, discard its stale tickets %s", srvt.ID, state.Tickets.Summary())
+			copied := *state
+			copied.Tickets = nil
+			state = &copied
+		} else if !ok && !h.Healthy {
+			if !m.ExclusiveHandoff {
+				log.M(util.ModuleName).Warningf("quarantine unhealthy servant %s, move its tickets off", srvt.ID)
+				continue
+			}
+			// revocation can not be confirmed, keep its tickets unassigned until its lease is gone or it recovers
+			tks, known := committed[srvt.ID]
+			log.M(util.ModuleName).Warningf("quarantine unhealthy servant %s, withhold its tickets %s", srvt.ID, tks.Summary())
+			for _, tk := range tks {
+				quarantined[tk.ID] = true
+			}
+			unknown = unknown || !known
+			continue
+		} else if !ok {
+			tks, known := committed[srvt.ID]
+			if !known {
+				log.M(util.ModuleName).Warningf("exclude servant %s from this round", srvt.ID)
+				unknown = true
+				continue
+			}
+			log.M(util.ModuleName).Warningf("servant %s not responding, assume it holds committed tickets %s", srvt.ID, tks.Summary())
+			state = &servantState{Tickets: tks}
+			held = state
+		}
+		if err = m.checkFencing(srvt.ID, state); err != nil {
+			log.M(util.ModuleName).Errorf("stale master:%v", err)
+			return nil, nil, err
+		}
+		servantTicketsM[srvt.ID] = held.Tickets
+		if !dryRun {
+			warnDeadLetters(srvt.ID, state.States, m.letters, letters)
+		}
+		current := append(tickets.Tickets(nil), state.Tickets...)
+		if m.AckTimeout > 0 {
+			for id, sid := range unackedTickets(srvt.ID, state.States, m.AckTimeout) {
+				stale[id] = sid
+			}
+		}
+		old = append(old, ServantPayload{
+			ServantID: srvt.ID,
+			// DispatchHandler may modify current tickets in place
+			Tickets:     current,
+			SystemStats: state.Stats,
+			Labels:      srvt.Labels,
+			Health:      h,
+			States:      state.States,
+		})
+	}
+	if !dryRun {
+		m.letters = letters
+	}
+
+	// dispatch
+	ctx := &DispatchContext{
+		Tickets:  catalog,
+		Current:  &CurrentDispatch{ServantPayloads: old},
+		Previous: m.committed,
+		Health:   health,
+		Unacked:  stale,
+	}
+	newDis := new(NewDispatch)
+	if err := m.strategy().Dispatch(ctx, newDis); err != nil {
+		log.M(util.ModuleName).Errorf("dispatch fail:%v", err)
+		return nil, nil, err
+	}
+	withholdTickets(newDis, quarantined)
+	if unknown {
+		withholdTickets(newDis, orphanTickets(servantTicketsM, newDis))
+	}
+	if err := ValidateDispatch(ctx, newDis); err != nil {
+		log.M(util.ModuleName).Errorf("reject dispatch:%v", err)
+		return nil, nil, err
+	}
+	return servantTicketsM, newDis, nil
+}
@@ -0,0 +1,860 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qjpcpu/servant-cluster/proto"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+func makeTickets(n int) tickets.Tickets {
+	var tks tickets.Tickets
+	for i := 0; i < n; i++ {
+		tks = append(tks, tickets.Ticket{ID: strconv.Itoa(i)})
+	}
+	return tks
+}
+
+func makeCurrent(servants ...string) *CurrentDispatch {
+	cur := &CurrentDispatch{}
+	for _, sid := range servants {
+		cur.ServantPayloads = append(cur.ServantPayloads, ServantPayload{ServantID: sid})
+	}
+	return cur
+}
+
+func owners(sp ServantPayloads) map[string]string {
+	m := make(map[string]string)
+	for _, p := range sp {
+		for _, t := range p.Tickets {
+			m[t.ID] = p.ServantID
+		}
+	}
+	return m
+}
+
+func TestConsistentHashDispatch(t *testing.T) {
+	tks := makeTickets(1000)
+	var before, after NewDispatch
+	if err := ConsistentHashDispatch(tks, makeCurrent("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"), &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConsistentHashDispatch(tks, makeCurrent("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80", "10.0.0.5:80"), &after); err != nil {
+		t.Fatal(err)
+	}
+	o1, o2 := owners(before.ServantPayloads), owners(after.ServantPayloads)
+	if len(o1) != len(tks) || len(o2) != len(tks) {
+		t.Fatalf("some tickets not dispatched: %d %d", len(o1), len(o2))
+	}
+	var moved int
+	for id, sid := range o1 {
+		if o2[id] != sid {
+			if o2[id] != "10.0.0.5:80" {
+				t.Fatalf("ticket %s moved between old servants", id)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(tks)*2/5 {
+		t.Fatalf("too many tickets moved: %d", moved)
+	}
+}
+
+func TestWeightedDispatch(t *testing.T) {
+	small, _ := tickets.WeightedSysInfoGetter(1, nil)()
+	big, _ := tickets.WeightedSysInfoGetter(3, nil)()
+	cur := makeCurrent("10.0.0.1:80", "10.0.0.2:80")
+	cur.ServantPayloads[0].SystemStats = small
+	cur.ServantPayloads[1].SystemStats = big
+	var newDis NewDispatch
+	if err := WeightedDispatch(makeTickets(8), cur, &newDis); err != nil {
+		t.Fatal(err)
+	}
+	if len(newDis.ServantPayloads[0].Tickets) != 2 || len(newDis.ServantPayloads[1].Tickets) != 6 {
+		t.Fatalf("bad weighted dispatch: %v", newDis.ServantPayloads)
+	}
+}
+
+func TestLabelAffinityDispatch(t *testing.T) {
+	tks := makeTickets(6)
+	tks[0].Labels = map[string]string{"region": "us"}
+	tks[1].Labels = map[string]string{"region": "eu"}
+	tks[2].Labels = map[string]string{"disk": "local"}
+	cur := makeCurrent("10.0.0.1:80", "10.0.0.2:80")
+	cur.ServantPayloads[0].Labels = map[string]string{"region": "us"}
+	cur.ServantPayloads[1].Labels = map[string]string{"region": "us", "disk": "local"}
+	var newDis NewDispatch
+	if err := LabelAffinityDispatch(tks, cur, &newDis); err != nil {
+		t.Fatal(err)
+	}
+	o := owners(newDis.ServantPayloads)
+	if o["2"] != "10.0.0.2:80" {
+		t.Fatalf("ticket 2 should go to servant with local disk, got %s", o["2"])
+	}
+	if _, ok := o["1"]; ok || len(newDis.Unassigned) != 1 || newDis.Unassigned[0].ID != "1" {
+		t.Fatalf("ticket 1 should be unassigned: %v", newDis.Unassigned)
+	}
+	if len(o) != 5 {
+		t.Fatalf("expect 5 tickets dispatched, got %d", len(o))
+	}
+}
+
+func TestPriorityDispatch(t *testing.T) {
+	tks := makeTickets(6)
+	tks[4].Priority = 10
+	tks[5].Priority = 5
+	stats, _ := tickets.ServantStatsGetter(tickets.ServantStats{MaxTickets: 2}, nil)()
+	cur := makeCurrent("10.0.0.1:80", "10.0.0.2:80")
+	cur.ServantPayloads[0].SystemStats = stats
+	cur.ServantPayloads[0].Tickets = tickets.Tickets{tks[3]}
+	cur.ServantPayloads[1].SystemStats = stats
+	var newDis NewDispatch
+	if err := PriorityDispatch(tks, cur, &newDis); err != nil {
+		t.Fatal(err)
+	}
+	o := owners(newDis.ServantPayloads)
+	for _, id := range []string{"4", "5", "0", "1"} {
+		if _, ok := o[id]; !ok {
+			t.Fatalf("ticket %s should be dispatched: %v", id, newDis.ServantPayloads)
+		}
+	}
+	if len(o) != 4 || newDis.Unassigned.Summary() != "[2,3]" {
+		t.Fatalf("ticket 2,3 should be left out: %s", newDis.Unassigned.Summary())
+	}
+}
+
+func TestConstraints(t *testing.T) {
+	tks := makeTickets(6)
+	tks[0].Group, tks[1].Group, tks[2].Group = "g", "g", "g"
+	tks[3].AntiAffinity, tks[4].AntiAffinity = "replica", "replica"
+	newDis := &NewDispatch{ServantPayloads: ServantPayloads{
+		{ServantID: "10.0.0.1:80", Tickets: tickets.Tickets{tks[0], tks[3], tks[4]}},
+		{ServantID: "10.0.0.1:81", Tickets: tickets.Tickets{tks[1], tks[2]}},
+		{ServantID: "10.0.0.2:80", Tickets: tickets.Tickets{tks[5]}},
+	}}
+	if err := ApplyConstraints(makeCurrent(), newDis, CoLocation(), AntiAffinity()); err != nil {
+		t.Fatal(err)
+	}
+	o := owners(newDis.ServantPayloads)
+	if o["0"] != "10.0.0.1:81" || o["1"] != o["0"] || o["2"] != o["0"] {
+		t.Fatalf("group tickets not co-located: %v", o)
+	}
+	if o["3"] == "" || o["4"] == "" || util.ServantHost(o["3"]) == util.ServantHost(o["4"]) {
+		t.Fatalf("anti affinity tickets on the same host: %v", o)
+	}
+
+	// ticket 4 moves off host 10.0.0.1 with its group, 10.0.0.2 does not match labels
+	tks[0].Group, tks[1].Group, tks[2].Group = "", "", ""
+	tks[3].Group, tks[4].Group = "", "g"
+	tks[4].Labels = map[string]string{"zone": "a"}
+	tks[5].Group, tks[5].Labels = "g", tks[4].Labels
+	cur := makeCurrent("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	cur.ServantPayloads[0].Labels = tks[4].Labels
+	cur.ServantPayloads[2].Labels = tks[4].Labels
+	newDis = &NewDispatch{ServantPayloads: ServantPayloads{
+		{ServantID: "10.0.0.1:80", Tickets: tickets.Tickets{tks[3], tks[4], tks[5]}},
+		{ServantID: "10.0.0.2:80"},
+		{ServantID: "10.0.0.3:80", Tickets: tickets.Tickets{tks[0]}},
+	}}
+	if err := ApplyConstraints(cur, newDis, AntiAffinity()); err != nil {
+		t.Fatal(err)
+	}
+	o = owners(newDis.ServantPayloads)
+	if o["3"] != "10.0.0.1:80" || o["4"] != "10.0.0.3:80" || o["5"] != o["4"] {
+		t.Fatalf("group should move as a unit to eligible servant: %v", o)
+	}
+
+	// majority servant 10.0.0.1 is full and 10.0.0.2 does not match labels
+	tks = makeTickets(5)
+	zone := map[string]string{"zone": "a"}
+	for _, i := range []int{0, 1, 3} {
+		tks[i].Group, tks[i].Labels = "h", zone
+	}
+	full, _ := tickets.ServantStatsGetter(tickets.ServantStats{MaxTickets: 2}, nil)()
+	cur = makeCurrent("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	cur.ServantPayloads[0].Labels, cur.ServantPayloads[0].SystemStats = zone, full
+	cur.ServantPayloads[2].Labels = zone
+	dispatch := func() *NewDispatch {
+		return &NewDispatch{ServantPayloads: ServantPayloads{
+			{ServantID: "10.0.0.1:80", Tickets: tickets.Tickets{tks[0], tks[1], tks[2]}},
+			{ServantID: "10.0.0.2:80", Tickets: tickets.Tickets{tks[3]}},
+			{ServantID: "10.0.0.3:80", Tickets: tickets.Tickets{tks[4]}},
+		}}
+	}
+	newDis = dispatch()
+	if err := ApplyConstraints(cur, newDis, CoLocation()); err != nil {
+		t.Fatal(err)
+	}
+	if o = owners(newDis.ServantPayloads); o["0"] != "10.0.0.3:80" || o["1"] != o["0"] || o["3"] != o["0"] || o["2"] != "10.0.0.1:80" {
+		t.Fatalf("group should move to the only eligible servant: %v", o)
+	}
+	cur.ServantPayloads[2].Labels = nil
+	newDis = dispatch()
+	if err := ApplyConstraints(cur, newDis, CoLocation()); err != nil {
+		t.Fatal(err)
+	}
+	if o = owners(newDis.ServantPayloads); len(o) != 2 || len(newDis.Unassigned) != 3 {
+		t.Fatalf("group no servant accepts should be unassigned: %v %v", o, newDis.Unassigned)
+	}
+}
+
+func TestLimitChurn(t *testing.T) {
+	tks := makeTickets(10)
+	cur := makeCurrent("10.0.0.1:80", "10.0.0.2:80")
+	cur.ServantPayloads[0].Tickets = append(tickets.Tickets(nil), tks...)
+	h := LimitChurn(func(last *CurrentDispatch, newDis *NewDispatch) error {
+		return ConservativeAverageDispatch(tks, last, newDis)
+	}, ChurnBudget{MaxMoves: 2})
+	var newDis NewDispatch
+	if err := h(cur, &newDis); err != nil {
+		t.Fatal(err)
+	}
+	o := owners(newDis.ServantPayloads)
+	var moved int
+	for _, sid := range o {
+		if sid == "10.0.0.2:80" {
+			moved++
+		}
+	}
+	if len(o) != 10 || moved != 2 {
+		t.Fatalf("expect 2 tickets moved, got %d", moved)
+	}
+}
+
+func TestDiffDispatch(t *testing.T) {
+	tks := makeTickets(4)
+	current := map[string]tickets.Tickets{
+		"10.0.0.1:80": {tks[0], tks[1]},
+		"10.0.0.2:80": {tks[2]},
+	}
+	newDis := &NewDispatch{ServantPayloads: ServantPayloads{
+		{ServantID: "10.0.0.1:80", Tickets: tickets.Tickets{tks[0], tks[3]}},
+		{ServantID: "10.0.0.3:80", Tickets: tickets.Tickets{tks[1], tks[2]}},
+	}}
+	plan := diffDispatch(current, newDis)
+	if len(plan.Servants) != 3 {
+		t.Fatalf("expect 3 servants in plan: %s", plan)
+	}
+	s1, s2, s3 := plan.Servants[0], plan.Servants[1], plan.Servants[2]
+	if s1.Kept.Summary() != "[0]" || s1.Added.Summary() != "[3]" || s1.Removed.Summary() != "[1]" {
+		t.Fatalf("bad plan of %s: %s", s1.ServantID, plan)
+	}
+	if s2.Removed.Summary() != "[2]" || len(s2.Added) != 0 || len(s2.Kept) != 0 {
+		t.Fatalf("bad plan of %s: %s", s2.ServantID, plan)
+	}
+	if s3.Added.Summary() != "[1,2]" {
+		t.Fatalf("bad plan of %s: %s", s3.ServantID, plan)
+	}
+}
+
+func TestStrategyChain(t *testing.T) {
+	tks := makeTickets(4)
+	s := Chain(TicketsStrategy(ConservativeAverageDispatch), PinningMiddleware(func() map[string]string {
+		return map[string]string{"0": "10.0.0.2:80", "1": "10.0.0.9:80"}
+	}))
+	ctx := &DispatchContext{Tickets: tks, Current: makeCurrent("10.0.0.1:80", "10.0.0.2:80")}
+	var newDis NewDispatch
+	if err := s.Dispatch(ctx, &newDis); err != nil {
+		t.Fatal(err)
+	}
+	o := owners(newDis.ServantPayloads)
+	if len(o) != 4 || o["0"] != "10.0.0.2:80" {
+		t.Fatalf("ticket 0 should be pinned: %v", o)
+	}
+}
+
+func TestValidateDispatch(t *testing.T) {
+	tks := makeTickets(4)
+	ctx := &DispatchContext{Tickets: tks, Current: makeCurrent("10.0.0.1:80", "10.0.0.2:80")}
+	newDis := &NewDispatch{
+		ServantPayloads: ServantPayloads{
+			{ServantID: "10.0.0.1:80", Tickets: tickets.Tickets{tks[0], tks[1]}},
+			{ServantID: "10.0.0.2:80", Tickets: tickets.Tickets{tks[1], {}}},
+			{ServantID: "10.0.0.3:80"},
+		},
+		Unassigned: tickets.Tickets{tks[2]},
+	}
+	err := ValidateDispatch(ctx, newDis)
+	verr, ok := err.(*DispatchValidationError)
+	if !ok {
+		t.Fatalf("expect validation error, got %v", err)
+	}
+	if len(verr.Duplicated["1"]) != 2 || len(verr.UnknownServants) != 1 || len(verr.EmptyTicketIDs) != 1 || len(verr.Dropped) != 1 || verr.Dropped[0] != "3" {
+		t.Fatalf("bad validation error: %v", verr)
+	}
+	var good NewDispatch
+	if err = ConservativeAverageDispatch(tks, ctx.Current, &good); err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateDispatch(ctx, &good); err != nil {
+		t.Fatal(err)
+	}
+
+	// legacy DispatchHandler has no catalog, tickets held by servants must not be dropped
+	legacy := &DispatchContext{Current: makeCurrent("10.0.0.1:80", "10.0.0.2:80")}
+	legacy.Current.ServantPayloads[0].Tickets = tks[:2]
+	legacy.Current.ServantPayloads[1].Tickets = tks[2:]
+	newDis = &NewDispatch{
+		ServantPayloads: ServantPayloads{{ServantID: "10.0.0.1:80", Tickets: tks[:2]}},
+		Unassigned:      tks[3:],
+	}
+	if verr, ok = ValidateDispatch(legacy, newDis).(*DispatchValidationError); !ok || len(verr.Dropped) != 1 || verr.Dropped[0] != "2" {
+		t.Fatalf("ticket 2 should be dropped: %v", verr)
+	}
+	newDis.Unassigned = tks[2:]
+	if err = ValidateDispatch(legacy, newDis); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	m := &Master{Concurrency: 2, RPCTimeout: 50 * time.Millisecond, RPCRetries: 1, RPCRetryBackoff: 30 * time.Millisecond}
+	start := time.Now()
+	var inflight, maxInflight, calls int32
+	errs := m.fanOut([]string{"a", "b", "c", "d", "hung"}, func(ctx context.Context, sid string) error {
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			old := atomic.LoadInt32(&maxInflight)
+			if n <= old || atomic.CompareAndSwapInt32(&maxInflight, old, n) {
+				break
+			}
+		}
+		if sid == "hung" {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if len(errs) != 1 || errs["hung"] == nil {
+		t.Fatalf("only hung servant should fail: %v", errs)
+	}
+	if maxInflight > 2 || calls != 6 {
+		t.Fatalf("bad fan out, max inflight %d calls %d", maxInflight, calls)
+	}
+	if elapsed := time.Since(start); elapsed < 130*time.Millisecond {
+		t.Fatalf("retry should back off, elapsed %v", elapsed)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	in, out, closeC := make(chan struct{}, 1), make(chan struct{}, 1), make(chan struct{})
+	defer close(closeC)
+	debounce(in, out, 30*time.Millisecond, 0, closeC)
+	for i := 0; i < 10; i++ {
+		in <- struct{}{}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case <-out:
+		t.Fatal("should not fire during burst")
+	default:
+	}
+	select {
+	case <-out:
+	case <-time.After(time.Second):
+		t.Fatal("should fire after quiet window")
+	}
+
+	in, out = make(chan struct{}, 1), make(chan struct{}, 1)
+	debounce(in, out, 30*time.Millisecond, 50*time.Millisecond, closeC)
+	start := time.Now()
+	go func() {
+		for i := 0; i < 20; i++ {
+			in <- struct{}{}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	<-out
+	if time.Since(start) > 150*time.Millisecond {
+		t.Fatalf("should fire at max delay, took %v", time.Since(start))
+	}
+}
+
+func TestRunAsLeader(t *testing.T) {
+	var became, lost int32
+	m := &Master{
+		OnBecomeLeader:   func() { atomic.AddInt32(&became, 1) },
+		OnLoseLeadership: func() { atomic.AddInt32(&lost, 1) },
+	}
+	var running int32
+	task := func(ctx context.Context) error {
+		atomic.AddInt32(&running, 1)
+		<-ctx.Done()
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+	m.RunAsLeader(task)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&running) != 0 {
+		t.Fatal("task should not run before leadership")
+	}
+	m.becomeLeader()
+	m.RunAsLeader(task)
+	time.Sleep(10 * time.Millisecond)
+	if !m.IsLeader() || atomic.LoadInt32(&running) != 2 {
+		t.Fatalf("tasks should run as leader, running %d", running)
+	}
+	m.loseLeadership()
+	if m.IsLeader() || atomic.LoadInt32(&running) != 0 {
+		t.Fatalf("tasks should exit on demotion, running %d", running)
+	}
+	m.becomeLeader()
+	m.loseLeadership()
+	if became != 2 || lost != 2 {
+		t.Fatalf("bad hooks, became %d lost %d", became, lost)
+	}
+}
+
+func TestMemoryElection(t *testing.T) {
+	me := NewMemoryElection()
+	e1, e2 := me.NewElector(), me.NewElector()
+	epoch1, err := e1.Campaign(context.Background(), "m1")
+	if err != nil || me.Leader() != "m1" {
+		t.Fatalf("m1 should be elected: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	if _, err = e2.Campaign(ctx, "m2"); err == nil {
+		t.Fatal("m2 should wait for m1")
+	}
+	cancel()
+	wonC := make(chan int64, 1)
+	go func() {
+		epoch, _ := e2.Campaign(context.Background(), "m2")
+		wonC <- epoch
+	}()
+	me.Expire()
+	select {
+	case <-e1.Lost():
+	default:
+		t.Fatal("m1 should lose leadership on expiry")
+	}
+	if epoch2 := <-wonC; epoch2 <= epoch1 || me.Leader() != "m2" {
+		t.Fatalf("m2 should be elected with newer epoch, %d <= %d", epoch2, epoch1)
+	}
+	e2.Resign(context.Background())
+	if me.Leader() != "" {
+		t.Fatal("no leader after resign")
+	}
+}
+
+// fakeCampaign is a session which expires when doneC is closed, campaign blocks on blockC if set
+type fakeCampaign struct {
+	rev    int64
+	doneC  chan struct{}
+	blockC chan struct{}
+	closed int32
+}
+
+func (c *fakeCampaign) Campaign(ctx context.Context, val string) error {
+	if c.blockC == nil {
+		return nil
+	}
+	select {
+	case <-c.blockC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+func (c *fakeCampaign) Rev() int64                       { return c.rev }
+func (c *fakeCampaign) Key() string                      { return "master/" + strconv.FormatInt(c.rev, 10) }
+func (c *fakeCampaign) Resign(ctx context.Context) error { return nil }
+func (c *fakeCampaign) Done() <-chan struct{}            { return c.doneC }
+func (c *fakeCampaign) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func TestEtcdElectorExpire(t *testing.T) {
+	var opened []*fakeCampaign
+	e := NewEtcdElector(nil, "master", 0)
+	e.open = func() (campaign, error) {
+		c := &fakeCampaign{rev: int64(len(opened) + 1), doneC: make(chan struct{})}
+		opened = append(opened, c)
+		return c, nil
+	}
+	if epoch, err := e.Campaign(context.Background(), "m1"); err != nil || epoch != 1 {
+		t.Fatalf("should be elected: %d %v", epoch, err)
+	}
+	if _, err := e.Campaign(context.Background(), "m1"); err == nil {
+		t.Fatal("should refuse campaign while leading")
+	}
+	close(opened[0].doneC)
+	<-e.Lost()
+	epoch, err := e.Campaign(context.Background(), "m1")
+	if err != nil || epoch != 2 {
+		t.Fatalf("should be elected again after session expired: %d %v", epoch, err)
+	}
+	if atomic.LoadInt32(&opened[0].closed) != 1 {
+		t.Fatal("expired session should be closed")
+	}
+
+	// standby campaign does not block other calls
+	e.Resign(context.Background())
+	blocked := &fakeCampaign{rev: 3, doneC: make(chan struct{}), blockC: make(chan struct{})}
+	e.open = func() (campaign, error) { return blocked, nil }
+	wonC := make(chan int64, 1)
+	go func() {
+		epoch, _ := e.Campaign(context.Background(), "m1")
+		wonC <- epoch
+	}()
+	returnC := make(chan struct{})
+	go func() {
+		e.Lost()
+		e.Close()
+		close(returnC)
+	}()
+	select {
+	case <-returnC:
+	case <-time.After(time.Second):
+		t.Fatal("Lost and Close should not wait for campaign")
+	}
+	close(blocked.blockC)
+	if epoch = <-wonC; epoch != 3 {
+		t.Fatalf("campaign should win with epoch 3: %d", epoch)
+	}
+}
+
+func TestResign(t *testing.T) {
+	me := NewMemoryElection()
+	m := &Master{ID: "m1", Elector: me.NewElector()}
+	if _, err := m.Elector.Campaign(context.Background(), m.ID); err != nil {
+		t.Fatal(err)
+	}
+	m.becomeLeader()
+	if err := m.Resign(""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-m.Elector.Lost():
+	default:
+		t.Fatal("should lose leadership after resign")
+	}
+	if me.Leader() != "" {
+		t.Fatal("election should be free after resign")
+	}
+	start := time.Now()
+	if !m.waitHoldoff() || time.Since(start) < resignHoldoff/2 {
+		t.Fatal("resigned master should hold off campaigning")
+	}
+}
+
+func TestServantHealth(t *testing.T) {
+	wa := newServantAccessor(nil, "servants", 2)
+	fail := errors.New("unavailable")
+	wa.observe("s1", time.Now(), fail)
+	if h := wa.Health("s1"); !h.Healthy || h.Failures != 1 {
+		t.Fatalf("one failure should not mark unhealthy: %+v", h)
+	}
+	wa.observe("s1", time.Now(), fail)
+	if h := wa.Health("s1"); h.Healthy || h.LastError != fail {
+		t.Fatalf("should be unhealthy at threshold: %+v", h)
+	}
+	wa.observe("s1", time.Now(), nil)
+	if h := wa.Health("s1"); !h.Healthy || !h.Recovered || h.Failures != 0 {
+		t.Fatalf("should recover after success: %+v", h)
+	}
+	wa.settle("s1")
+	if h := wa.Health("s1"); h.Recovered {
+		t.Fatal("should settle after push")
+	}
+	wa.evictExcept(nil)
+	if _, ok := wa.health["s1"]; ok {
+		t.Fatal("health of gone servant should be dropped")
+	}
+}
+
+func TestDispatchRecord(t *testing.T) {
+	tks := makeTickets(3)
+	current := map[string]tickets.Tickets{"s1": tks[:2], "s2": tks[2:]}
+	newDis := &NewDispatch{
+		ServantPayloads: ServantPayloads{
+			{ServantID: "s1", Tickets: tks[:1]},
+			{ServantID: "s2", Tickets: tks[1:]},
+		},
+	}
+	var pt pendingTriggers
+	pt.add(TriggerMembership)
+	pt.add(TriggerManual)
+	pt.add(TriggerMembership)
+	triggers := pt.take()
+	if len(triggers) != 2 || len(pt.take()) != 0 {
+		t.Fatalf("bad pending triggers %v", triggers)
+	}
+	r := newDispatchRecord("m1", 7, triggers, diffDispatch(current, newDis), nil)
+	if len(r.Changes) != 2 {
+		t.Fatalf("both servants should change: %+v", r.Changes)
+	}
+	if c := r.Changes[0]; c.ServantID != "s1" || len(c.Added) != 0 || len(c.Removed) != 1 || c.Removed[0] != tks[1].ID {
+		t.Fatalf("bad s1 change %+v", c)
+	}
+	if c := r.Changes[1]; c.ServantID != "s2" || len(c.Added) != 1 || c.Added[0] != tks[1].ID {
+		t.Fatalf("bad s2 change %+v", c)
+	}
+	r = newDispatchRecord("m1", 7, triggers, diffDispatch(current, newDis), map[string]error{"s2": errors.New("timeout")})
+	if len(r.Changes) != 1 || r.Changes[0].ServantID != "s1" {
+		t.Fatalf("failed push should not be recorded: %+v", r.Changes)
+	}
+}
+
+func TestReassignUnacked(t *testing.T) {
+	tks := makeTickets(5)
+	states := map[string]tickets.TicketStatus{
+		tks[0].ID: {ID: tks[0].ID, State: tickets.TicketAssigned, Since: time.Now().Add(-time.Minute)},
+		tks[1].ID: {ID: tks[1].ID, State: tickets.TicketAssigned, Since: time.Now()},
+		tks[2].ID: {ID: tks[2].ID, State: tickets.TicketRunning, Since: time.Now().Add(-time.Minute)},
+	}
+	stale := unackedTickets("s1", states, 10*time.Second)
+	if len(stale) != 1 || stale[tks[0].ID] != "s1" {
+		t.Fatalf("only ticket 0 should be stale: %v", stale)
+	}
+	// s3 is full, so ticket 0 can only move to s2
+	full, _ := tickets.ServantStatsGetter(tickets.ServantStats{MaxTickets: 1}, nil)()
+	ctx := &DispatchContext{Current: makeCurrent("s1", "s2", "s3"), Unacked: stale}
+	ctx.Current.ServantPayloads[2].SystemStats = full
+	s := Chain(DispatchStrategyFunc(func(ctx *DispatchContext, newDis *NewDispatch) error {
+		newDis.ServantPayloads = ServantPayloads{
+			{ServantID: "s1", Tickets: tks[:3]},
+			{ServantID: "s2", Tickets: tks[3:]},
+			{ServantID: "s3", Tickets: tickets.Tickets{{ID: "x"}}},
+		}
+		return nil
+	}), UnackedMiddleware())
+	newDis := new(NewDispatch)
+	if err := s.Dispatch(ctx, newDis); err != nil {
+		t.Fatal(err)
+	}
+	if o := owners(newDis.ServantPayloads); o[tks[0].ID] != "s2" || o[tks[1].ID] != "s1" {
+		t.Fatalf("stale ticket should move to s2: %v", o)
+	}
+}
+
+func TestHandoffWithhold(t *testing.T) {
+	tks := makeTickets(3)
+	current := map[string]tickets.Tickets{"s1": tks[:1], "s2": nil}
+	newDis := &NewDispatch{
+		ServantPayloads: ServantPayloads{
+			{ServantID: "s1", Tickets: tks[:1]},
+			{ServantID: "s2", Tickets: tks[1:]},
+		},
+	}
+	granted := grantedTickets(current, newDis)
+	if len(granted) != 2 || granted[tks[1].ID] != "s2" {
+		t.Fatalf("tickets 1 and 2 should be granted to s2: %v", granted)
+	}
+	// ticket 1 withheld in former round is still running on s1
+	states := map[string]*servantState{
+		"s1": {Tickets: tks[:1], Running: []string{tks[0].ID, tks[1].ID}},
+		"s2": {Running: []string{tks[2].ID}},
+	}
+	running := runningElsewhere(granted, states)
+	if len(running) != 1 || running[tks[1].ID] != "s1" {
+		t.Fatalf("only ticket 1 should be running elsewhere: %v", running)
+	}
+	if orphans := orphanTickets(current, newDis); len(orphans) != 2 || orphans[tks[0].ID] {
+		t.Fatalf("tickets 1 and 2 are held by nobody: %v", orphans)
+	}
+	withholdTickets(newDis, map[string]bool{tks[1].ID: true})
+	if o := owners(newDis.ServantPayloads); len(o) != 2 || len(newDis.Unassigned) != 1 || newDis.Unassigned[0].ID != tks[1].ID {
+		t.Fatalf("ticket 1 should be withheld: %v %v", o, newDis.Unassigned)
+	}
+}
+
+func TestRevokeBeforeGrant(t *testing.T) {
+	// s1 is still running ticket 0 after revocation
+	s1, stop1 := startFakeServant(t, &proto.TicketsInfo{RunningIds: []string{"0"}})
+	defer stop1()
+	s2, stop2 := startFakeServant(t, &proto.TicketsInfo{})
+	defer stop2()
+	m := &Master{HandoffTimeout: time.Minute, sa: newServantAccessor(nil, "servants", 0)}
+	defer m.sa.Close()
+	tks := makeTickets(2)
+	current := map[string]tickets.Tickets{s1: tks, s2: nil}
+	newDis := &NewDispatch{
+		ServantPayloads: ServantPayloads{
+			{ServantID: s1, Tickets: tks[1:]},
+			{ServantID: s2, Tickets: tks[:1]},
+		},
+	}
+	start := time.Now()
+	if !m.revokeBeforeGrant(current, newDis) {
+		t.Fatal("ticket 0 should be withheld")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("revocation should not be waited for")
+	}
+	if o := owners(newDis.ServantPayloads); len(o) != 1 || o["1"] != s1 || len(newDis.Unassigned) != 1 {
+		t.Fatalf("ticket 0 should be granted in a later round: %v %v", o, newDis.Unassigned)
+	}
+	if len(current[s1]) != 1 || current[s1][0].ID != "1" {
+		t.Fatalf("ticket 0 should be revoked from s1: %v", current[s1])
+	}
+}
+
+func TestAssignmentRoundTrip(t *testing.T) {
+	tks := makeTickets(3)
+	for i := range tks {
+		tks[i].Content = []byte("content " + tks[i].ID)
+		tks[i].Labels = map[string]string{"zone": "a"}
+	}
+	data, err := json.Marshal(newAssignment("m1", 7, ServantPayloads{
+		{ServantID: "s1", Tickets: tks[:2]},
+		{ServantID: "s2", Tickets: tks[2:]},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := new(Assignment)
+	if err = json.Unmarshal(data, a); err != nil {
+		t.Fatal(err)
+	}
+	if a.MasterID != "m1" || a.Epoch != 7 {
+		t.Fatalf("bad assignment %+v", a)
+	}
+	if sp := a.Payloads(nil); len(sp) != 2 || len(sp[0].Tickets) != 0 || len(sp[1].Tickets) != 0 {
+		t.Fatalf("tickets known by id only should be left out: %+v", sp)
+	}
+	for _, p := range a.Payloads(tks) {
+		want := tks[2:]
+		if p.ServantID == "s1" {
+			want = tks[:2]
+		}
+		if !p.Tickets.Equals(want) || string(p.Tickets[0].Content) != string(want[0].Content) || p.Tickets[0].Labels["zone"] != "a" {
+			t.Fatalf("tickets of %s should be resolved from catalog: %+v", p.ServantID, p.Tickets)
+		}
+	}
+	// content of committed tickets is refreshed from catalog, removed tickets are still held
+	updated := tickets.Ticket{ID: tks[2].ID, Content: []byte("updated")}
+	held := refreshTickets(ServantPayloads{{ServantID: "s1", Tickets: tks[:2]}, {ServantID: "s2", Tickets: tks[2:]}}, tickets.Tickets{updated})
+	if string(held["s2"][0].Content) != "updated" || string(held["s1"][1].Content) != string(tks[1].Content) {
+		t.Fatalf("bad refreshed tickets %+v", held)
+	}
+}
+
+// fakeDispatcher report info as servant state, one ticket if nil
+type fakeDispatcher struct {
+	info *proto.TicketsInfo
+}
+
+func (d fakeDispatcher) GetTickets(context.Context, *proto.Empty) (*proto.TicketsInfo, error) {
+	if d.info != nil {
+		return d.info, nil
+	}
+	return &proto.TicketsInfo{TicketsInfo: []*proto.TicketInfo{{Id: "1"}}}, nil
+}
+
+func (fakeDispatcher) SetTickets(context.Context, *proto.TicketsInfo) (*proto.Empty, error) {
+	return &proto.Empty{}, nil
+}
+
+func startFakeServant(t *testing.T, info ...*proto.TicketsInfo) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	d := fakeDispatcher{}
+	if len(info) > 0 {
+		d.info = info[0]
+	}
+	proto.RegisterTicketDispatcherServer(s, d)
+	go s.Serve(l)
+	return l.Addr().String(), s.Stop
+}
+
+func TestServantConns(t *testing.T) {
+	s1, stop1 := startFakeServant(t)
+	defer stop1()
+	s2, stop2 := startFakeServant(t)
+	defer stop2()
+	m := &Master{sa: newServantAccessor(nil, "servants", 0)}
+	defer m.sa.Close()
+	ctx := context.Background()
+	for _, sid := range []string{s1, s2, s1} {
+		if state, err := m.sa.GetServantTickets(ctx, sid); err != nil || len(state.Tickets) != 1 {
+			t.Fatalf("get %s tickets fail: %v", sid, err)
+		}
+	}
+	if states := m.ConnStates(); len(states) != 2 || states[s1] != connectivity.Ready {
+		t.Fatalf("one cached connection per servant: %v", states)
+	}
+	conn := m.sa.conns[s1]
+
+	// broken connection is dropped and redialed
+	conn.Close()
+	m.sa.checkConn(s1, conn)
+	if _, ok := m.ConnStates()[s1]; ok {
+		t.Fatal("broken connection should be dropped")
+	}
+	if err := m.sa.SetServantTickets(ctx, s1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.sa.conns[s1] == conn {
+		t.Fatal("connection should be redialed")
+	}
+
+	// servant left cluster
+	m.sa.observe(s2, time.Now(), errors.New("timeout"))
+	conn = m.sa.conns[s2]
+	m.sa.evictExcept(map[string]bool{s1: true})
+	if states := m.ConnStates(); len(states) != 1 || conn.GetState() != connectivity.Shutdown {
+		t.Fatalf("connection of left servant should be closed: %v", states)
+	}
+	if h := m.sa.Health(s2); h.Failures != 0 {
+		t.Fatalf("health of left servant should be forgotten: %+v", h)
+	}
+	m.sa.evict(s1)
+	if states := m.ConnStates(); len(states) != 0 {
+		t.Fatalf("evicted connection should be closed: %v", states)
+	}
+}
+
+func TestDispatchUnacked(t *testing.T) {
+	// ticket 1 is never started on s1
+	s1, stop1 := startFakeServant(t, &proto.TicketsInfo{
+		TicketsInfo:  []*proto.TicketInfo{{Id: "1", Labels: map[string]string{"zone": "a"}}, {Id: "2"}},
+		TicketStates: []*proto.TicketStatus{{Id: "1", State: proto.TicketState(tickets.TicketAssigned), Elapsed: int64(time.Minute)}},
+	})
+	defer stop1()
+	s2, stop2 := startFakeServant(t, &proto.TicketsInfo{})
+	defer stop2()
+	s3, stop3 := startFakeServant(t, &proto.TicketsInfo{})
+	defer stop3()
+	m := &Master{
+		AckTimeout: 10 * time.Second,
+		// legacy handler keeps current dispatch
+		DispatchHandler: func(cur *CurrentDispatch, newDis *NewDispatch) error {
+			newDis.ServantPayloads = append(newDis.ServantPayloads, cur.ServantPayloads...)
+			return nil
+		},
+		sa: newServantAccessor(nil, "servants", 0),
+	}
+	defer m.sa.Close()
+	// s3 does not match labels of ticket 1
+	m.sa.list = func() ([]util.ServantMeta, error) {
+		return []util.ServantMeta{
+			{ID: s1, Labels: map[string]string{"zone": "a"}},
+			{ID: s3, Labels: map[string]string{"zone": "b"}},
+			{ID: s2, Labels: map[string]string{"zone": "a"}},
+		}, nil
+	}
+	_, newDis, err := m.dispatchOnce(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := owners(newDis.ServantPayloads); o["1"] != s2 || o["2"] != s1 {
+		t.Fatalf("unacknowledged ticket should move to s2: %v", o)
+	}
+}
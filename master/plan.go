@@ -0,0 +1,97 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/qjpcpu/servant-cluster/tickets"
+)
+
+// DispatchPlan is the difference between current dispatch and the new dispatch
+type DispatchPlan struct {
+	Servants []ServantPlan
+	// tickets intentionally left out by dispatch
+	Unassigned tickets.Tickets
+}
+
+// ServantPlan is the tickets change of one servant
+type ServantPlan struct {
+	ServantID string
+	Added     tickets.Tickets
+	Removed   tickets.Tickets
+	Kept      tickets.Tickets
+}
+
+// Changed report whether the servant tickets would change
+func (sp ServantPlan) Changed() bool {
+	return len(sp.Added) > 0 || len(sp.Removed) > 0
+}
+
+func (p *DispatchPlan) String() string {
+	var lines []string
+	for _, s := range p.Servants {
+		lines = append(lines, fmt.Sprintf("%s +%s -%s =%s", s.ServantID, s.Added.Summary(), s.Removed.Summary(), s.Kept.Summary()))
+	}
+	if len(p.Unassigned) > 0 {
+		lines = append(lines, "unassigned "+p.Unassigned.Summary())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Plan run DispatchHandler against live cluster state without pushing the result to servants
+func (m *Master) Plan() (*DispatchPlan, error) {
+	m.round.Lock()
+	defer m.round.Unlock()
+	if m.sa == nil {
+		return nil, errors.New("master is not running")
+	}
+	servantTicketsM, newDis, err := m.dispatchOnce(true)
+	if err != nil {
+		return nil, err
+	}
+	return diffDispatch(servantTicketsM, newDis), nil
+}
+
+func diffDispatch(current map[string]tickets.Tickets, newDis *NewDispatch) *DispatchPlan {
+	plan := &DispatchPlan{Unassigned: newDis.Unassigned}
+	seen := make(map[string]bool)
+	for _, p := range newDis.ServantPayloads {
+		seen[p.ServantID] = true
+		plan.Servants = append(plan.Servants, diffTickets(p.ServantID, current[p.ServantID], p.Tickets))
+	}
+	for sid, tks := range current {
+		if !seen[sid] {
+			plan.Servants = append(plan.Servants, diffTickets(sid, tks, nil))
+		}
+	}
+	sort.Slice(plan.Servants, func(i, j int) bool { return plan.Servants[i].ServantID < plan.Servants[j].ServantID })
+	return plan
+}
+
+func diffTickets(sid string, old, next tickets.Tickets) ServantPlan {
+	sp := ServantPlan{ServantID: sid}
+	oldM := make(map[string]bool)
+	for _, tk := range old {
+		oldM[tk.ID] = true
+	}
+	newM := make(map[string]bool)
+	for _, tk := range next {
+		newM[tk.ID] = true
+		if oldM[tk.ID] {
+			sp.Kept = append(sp.Kept, tk)
+		} else {
+			sp.Added = append(sp.Added, tk)
+		}
+	}
+	for _, tk := range old {
+		if !newM[tk.ID] {
+			sp.Removed = append(sp.Removed, tk)
+		}
+	}
+	sort.Sort(sp.Added)
+	sort.Sort(sp.Removed)
+	sort.Sort(sp.Kept)
+	return sp
+}
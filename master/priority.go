@@ -0,0 +1,97 @@
+package master
+
+import (
+	"sort"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// PriorityDispatch dispatch tickets within servant capacities reported by tickets.ServantStatsGetter,
+// when total capacity is smaller than ticket count, high priority tickets are always placed
+// while low priority tickets are left out (and preempted if dispatched before) into NewDispatch.Unassigned
+func PriorityDispatch(tks tickets.Tickets, last *CurrentDispatch, newDis *NewDispatch) error {
+	if len(last.ServantPayloads) == 0 {
+		return nil
+	}
+	payloads := make(ServantPayloads, len(last.ServantPayloads))
+	copy(payloads, last.ServantPayloads)
+	sort.Sort(payloads)
+
+	capacities := make([]int, len(payloads))
+	totalCapacity := 0
+	for i, p := range payloads {
+		capacities[i] = ServantCapacity(p)
+		if capacities[i] < 0 || totalCapacity < 0 {
+			totalCapacity = -1
+		} else {
+			totalCapacity += capacities[i]
+		}
+	}
+	sorted := make(tickets.Tickets, len(tks))
+	copy(sorted, tks)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority > sorted[j].Priority
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	admitted := sorted
+	if totalCapacity >= 0 && totalCapacity < len(sorted) {
+		admitted = sorted[:totalCapacity]
+		newDis.Unassigned = append(newDis.Unassigned, sorted[totalCapacity:]...)
+		log.M(util.ModuleName).Warningf("servants capacity %d is less than %d tickets, leave out %s", totalCapacity, len(sorted), newDis.Unassigned.Summary())
+	}
+	hasRoom := func(i, load int) bool {
+		return capacities[i] < 0 || load < capacities[i]
+	}
+
+	ticketMap := make(map[string]tickets.Ticket)
+	for _, tk := range admitted {
+		ticketMap[tk.ID] = tk
+	}
+	average := (len(admitted) + len(payloads) - 1) / len(payloads)
+	newPayloads := make(ServantPayloads, len(payloads))
+	for i, lastp := range payloads {
+		newPayloads[i].ServantID = lastp.ServantID
+		for _, tk := range lastp.Tickets {
+			n := len(newPayloads[i].Tickets)
+			if n >= average || !hasRoom(i, n) {
+				break
+			}
+			if nt, ok := ticketMap[tk.ID]; ok {
+				newPayloads[i].Tickets = append(newPayloads[i].Tickets, nt)
+				delete(ticketMap, tk.ID)
+			}
+		}
+	}
+	for _, tk := range admitted {
+		if _, ok := ticketMap[tk.ID]; !ok {
+			continue
+		}
+		idx := -1
+		for i := range newPayloads {
+			n := len(newPayloads[i].Tickets)
+			if hasRoom(i, n) && (idx == -1 || n < len(newPayloads[idx].Tickets)) {
+				idx = i
+			}
+		}
+		if idx == -1 {
+			newDis.Unassigned = append(newDis.Unassigned, tk)
+			continue
+		}
+		newPayloads[idx].Tickets = append(newPayloads[idx].Tickets, tk)
+	}
+	newDis.ServantPayloads = newPayloads
+	return nil
+}
+
+// ServantCapacity return max tickets reported by servant, -1 means unlimited
+func ServantCapacity(p ServantPayload) int {
+	st, err := tickets.ParseServantStats(p.SystemStats)
+	if err != nil || st.MaxTickets <= 0 {
+		return -1
+	}
+	return st.MaxTickets
+}
@@ -0,0 +1,100 @@
+package master
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/util"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// resignHoldoff is how long a resigned master stays out of election so a standby takes over
+const resignHoldoff = 2 * time.Second
+
+// Resign step down if this process is master so a standby takes over at once,
+// successor is id of the preferred next master, empty for any standby
+func (m *Master) Resign(successor string) error {
+	if !m.IsLeader() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+	defer cancel()
+	if successor != "" && successor != m.ID {
+		if err := m.putSuccessor(ctx, successor); err != nil {
+			return err
+		}
+	}
+	return m.stepDown(ctx)
+}
+
+func (m *Master) stepDown(ctx context.Context) error {
+	if m.Elector == nil {
+		return errors.New("master not running")
+	}
+	atomic.StoreInt64(&m.holdoffUntil, time.Now().Add(resignHoldoff).UnixNano())
+	log.M(util.ModuleName).Infof("master %s resign", m.ID)
+	return m.Elector.Resign(ctx)
+}
+
+// putSuccessor leave a hint of preferred successor, it expires with election ttl in case successor is gone
+func (m *Master) putSuccessor(ctx context.Context, successor string) error {
+	ttl := m.ElectionTTL
+	if ttl <= 0 {
+		ttl = DefaultElectionTTL
+	}
+	lease, err := m.EtcdCli.Grant(ctx, int64(ttl))
+	if err != nil {
+		return err
+	}
+	_, err = m.EtcdCli.Put(ctx, util.SuccessorKey(m.Prefix), successor, clientv3.WithLease(lease.ID))
+	return err
+}
+
+// deferToSuccessor resign once per hint when another process is the preferred successor, return true if resigned
+func (m *Master) deferToSuccessor() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRPCTimeout)
+	defer cancel()
+	key := util.SuccessorKey(m.Prefix)
+	resp, err := m.EtcdCli.Get(ctx, key)
+	if err != nil {
+		log.M(util.ModuleName).Warningf("get preferred successor fail:%v", err)
+		return false
+	}
+	if len(resp.Kvs) == 0 {
+		return false
+	}
+	kv := resp.Kvs[0]
+	successor := string(kv.Value)
+	if successor == m.ID {
+		// taken over as preferred, hint is done
+		m.EtcdCli.Delete(ctx, key)
+		return false
+	}
+	if kv.ModRevision == m.deferredRev {
+		log.M(util.ModuleName).Warningf("preferred successor %s does not take over, keep master", successor)
+		return false
+	}
+	log.M(util.ModuleName).Infof("defer master to preferred successor %s", successor)
+	m.deferredRev = kv.ModRevision
+	if err = m.stepDown(ctx); err != nil {
+		log.M(util.ModuleName).Warningf("resign fail:%v", err)
+	}
+	return true
+}
+
+// waitHoldoff wait until holdoff of last resignation passes, return false if master is stopped
+func (m *Master) waitHoldoff() bool {
+	d := time.Until(time.Unix(0, atomic.LoadInt64(&m.holdoffUntil)))
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-m.closeC:
+		return false
+	}
+}
@@ -3,31 +3,93 @@ package master
 import (
 	"context"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/qjpcpu/log"
 	"github.com/qjpcpu/servant-cluster/proto"
 	"github.com/qjpcpu/servant-cluster/tickets"
 	"github.com/qjpcpu/servant-cluster/util"
 	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
 )
 
+// keepalive of connections to servants, servant grpc server should permit it
+var servantKeepalive = keepalive.ClientParameters{
+	Time:                30 * time.Second,
+	Timeout:             10 * time.Second,
+	PermitWithoutStream: true,
+}
+
+// servantState is reported by servant
+type servantState struct {
+	Tickets tickets.Tickets
+	Stats   []byte
+	// tickets whose handler is running
+	Running []string
+	// ticket id to its state on servant
+	States map[string]tickets.TicketStatus
+	// newest master seen by servant
+	MasterID string
+	Epoch    int64
+}
+
 type servantAccessor struct {
 	cli *clientv3.Client
 	key string
+	// fencing token attached to SetTickets
+	mutex    *sync.Mutex
+	masterID string
+	epoch    int64
+	// persistent connections keyed by servant id
+	connMutex *sync.Mutex
+	conns     map[string]*grpc.ClientConn
+	// rpc health keyed by servant id
+	healthMutex        *sync.Mutex
+	health             map[string]*ServantHealth
+	unhealthyThreshold int
+	// list live servants, etcd registry by default
+	list func() ([]util.ServantMeta, error)
 }
 
-func newServantAccessor(cli *clientv3.Client, key string) *servantAccessor {
+func newServantAccessor(cli *clientv3.Client, key string, unhealthyThreshold int) *servantAccessor {
 	if !strings.HasSuffix(key, "/") {
 		key += "/"
 	}
-	return &servantAccessor{
-		cli: cli,
-		key: key,
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = DefaultUnhealthyThreshold
 	}
+	wa := &servantAccessor{
+		cli:                cli,
+		key:                key,
+		mutex:              new(sync.Mutex),
+		connMutex:          new(sync.Mutex),
+		conns:              make(map[string]*grpc.ClientConn),
+		healthMutex:        new(sync.Mutex),
+		health:             make(map[string]*ServantHealth),
+		unhealthyThreshold: unhealthyThreshold,
+	}
+	wa.list = wa.etcdServants
+	return wa
+}
+
+func (wa *servantAccessor) setFencing(masterID string, epoch int64) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	wa.masterID, wa.epoch = masterID, epoch
 }
 
-func (wa *servantAccessor) watch(notifyC chan<- struct{}, closeC <-chan struct{}) error {
+func (wa *servantAccessor) fencing() (string, int64) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	return wa.masterID, wa.epoch
+}
+
+// watch notify membershipC when servants join or leave, and manualC when servant requests reschedule
+func (wa *servantAccessor) watch(membershipC, manualC chan<- struct{}, closeC <-chan struct{}) error {
 	wchan := wa.cli.Watch(context.Background(), wa.key, clientv3.WithPrefix())
 	go func() {
 		for {
@@ -42,11 +104,20 @@ func (wa *servantAccessor) watch(notifyC chan<- struct{}, closeC <-chan struct{}
 				} else if wr.Created {
 					log.M(util.ModuleName).Debug("servant watch is created.")
 				} else {
-					log.M(util.ModuleName).Debug("servants cluster changed.")
-					select {
-					case notifyC <- struct{}{}:
-					default:
+					for _, ev := range wr.Events {
+						notifyC := membershipC
+						if ev.Type == mvccpb.DELETE {
+							wa.evict(util.ParseServantMeta(string(ev.Kv.Key), nil).ID)
+						} else if ev.Kv.Version > 1 {
+							// servant re-puts its key to request reschedule
+							notifyC = manualC
+						}
+						select {
+						case notifyC <- struct{}{}:
+						default:
+						}
 					}
+					log.M(util.ModuleName).Debug("servants cluster changed.")
 				}
 			}
 		}
@@ -54,7 +125,22 @@ func (wa *servantAccessor) watch(notifyC chan<- struct{}, closeC <-chan struct{}
 	return nil
 }
 
-func (wa *servantAccessor) GetServants() ([]string, error) {
+func (wa *servantAccessor) GetServants() ([]util.ServantMeta, error) {
+	list, err := wa.list()
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	alive := make(map[string]bool)
+	for _, meta := range list {
+		alive[meta.ID] = true
+	}
+	wa.evictExcept(alive)
+	log.M(util.ModuleName).Debugf("get servants:%v", list)
+	return list, nil
+}
+
+// etcdServants list servants registered in etcd
+func (wa *servantAccessor) etcdServants() ([]util.ServantMeta, error) {
 	resp, err := wa.cli.Get(context.Background(), wa.key, clientv3.WithPrefix())
 	if err != nil {
 		return nil, err
@@ -63,58 +149,197 @@ func (wa *servantAccessor) GetServants() ([]string, error) {
 		log.M(util.ModuleName).Debug("no servants ready.")
 		return nil, nil
 	}
-	var list []string
+	var list []util.ServantMeta
 	for _, kv := range resp.Kvs {
-		tokens := strings.Split(string(kv.Key), "/")
-		list = append(list, tokens[len(tokens)-1])
+		list = append(list, util.ParseServantMeta(string(kv.Key), kv.Value))
 	}
-	log.M(util.ModuleName).Debugf("get servants:%v", list)
 	return list, nil
 }
 
-func (wa *servantAccessor) GetServantTickets(wid string) (tickets.Tickets, []byte, error) {
-	conn, err := grpc.Dial(wid, grpc.WithInsecure())
+func (wa *servantAccessor) GetServantTickets(ctx context.Context, wid string) (*servantState, error) {
+	return wa.servantTickets(ctx, wid, true)
+}
+
+// PeekServantTickets get servant state without affecting its health
+func (wa *servantAccessor) PeekServantTickets(ctx context.Context, wid string) (*servantState, error) {
+	return wa.servantTickets(ctx, wid, false)
+}
+
+func (wa *servantAccessor) servantTickets(ctx context.Context, wid string, observe bool) (*servantState, error) {
+	conn, err := wa.conn(wid)
 	if err != nil {
-		return nil, nil, err
+		if observe {
+			wa.observe(wid, time.Now(), err)
+		}
+		return nil, err
 	}
-	defer conn.Close()
 	client := proto.NewTicketDispatcherClient(conn)
-	info, err := client.GetTickets(context.Background(), &proto.Empty{})
+	start := time.Now()
+	info, err := client.GetTickets(ctx, &proto.Empty{})
+	if observe {
+		wa.observe(wid, start, err)
+	}
 	if err != nil {
+		wa.checkConn(wid, conn)
 		log.M(util.ModuleName).Errorf("get servant tickets fail:%v", err)
-		return nil, nil, err
+		return nil, err
 	}
 	var tks tickets.Tickets
 	for _, tk := range info.TicketsInfo {
 		tks = append(tks, tickets.Ticket{
-			ID:      tk.Id,
-			Content: tk.Content,
-			Type:    tickets.TicketType(tk.Type),
+			ID:           tk.Id,
+			Content:      tk.Content,
+			Type:         tickets.TicketType(tk.Type),
+			Labels:       tk.Labels,
+			Priority:     tk.Priority,
+			Group:        tk.Group,
+			AntiAffinity: tk.AntiAffinity,
 		})
 	}
+	states := make(map[string]tickets.TicketStatus)
+	now := time.Now()
+	for _, st := range info.TicketStates {
+		states[st.Id] = tickets.TicketStatus{
+			ID:    st.Id,
+			State: tickets.TicketState(st.State),
+			// servant reports elapsed time to avoid clock skew
+			Since:    now.Add(-time.Duration(st.Elapsed)),
+			Error:    st.Error,
+			Attempts: int(st.Attempts),
+		}
+	}
 	var stats []byte
 	if sys := info.GetSysInfo(); sys != nil {
 		stats = sys.GetStats()
 	}
-	return tks, stats, nil
+	return &servantState{
+		Tickets:  tks,
+		Stats:    stats,
+		Running:  info.RunningIds,
+		States:   states,
+		MasterID: info.MasterId,
+		Epoch:    info.Epoch,
+	}, nil
 }
 
-func (wa *servantAccessor) SetServantTickets(wid string, tks tickets.Tickets) error {
-	conn, err := grpc.Dial(wid, grpc.WithInsecure())
+func (wa *servantAccessor) SetServantTickets(ctx context.Context, wid string, tks tickets.Tickets) error {
+	conn, err := wa.conn(wid)
 	if err != nil {
+		wa.observe(wid, time.Now(), err)
 		log.M(util.ModuleName).Errorf("set servant tickets fail:%v", err)
 		return err
 	}
-	defer conn.Close()
 	client := proto.NewTicketDispatcherClient(conn)
 	ti := &proto.TicketsInfo{}
+	ti.MasterId, ti.Epoch = wa.fencing()
 	for _, tk := range tks {
 		ti.TicketsInfo = append(ti.TicketsInfo, &proto.TicketInfo{
-			Id:      tk.ID,
-			Content: tk.Content,
-			Type:    int32(tk.Type),
+			Id:           tk.ID,
+			Content:      tk.Content,
+			Type:         int32(tk.Type),
+			Labels:       tk.Labels,
+			Priority:     tk.Priority,
+			Group:        tk.Group,
+			AntiAffinity: tk.AntiAffinity,
 		})
 	}
-	_, err = client.SetTickets(context.Background(), ti)
+	start := time.Now()
+	_, err = client.SetTickets(ctx, ti)
+	wa.observe(wid, start, err)
+	if err != nil {
+		wa.checkConn(wid, conn)
+	}
 	return err
 }
+
+// conn return cached connection to servant, dial if absent
+func (wa *servantAccessor) conn(wid string) (*grpc.ClientConn, error) {
+	wa.connMutex.Lock()
+	defer wa.connMutex.Unlock()
+	if conn, ok := wa.conns[wid]; ok {
+		if conn.GetState() != connectivity.Shutdown {
+			return conn, nil
+		}
+		delete(wa.conns, wid)
+	}
+	conn, err := grpc.Dial(wid, grpc.WithInsecure(), grpc.WithKeepaliveParams(servantKeepalive))
+	if err != nil {
+		return nil, err
+	}
+	wa.conns[wid] = conn
+	return conn, nil
+}
+
+// checkConn drop broken connection after a failed call so the next call redials
+func (wa *servantAccessor) checkConn(wid string, conn *grpc.ClientConn) {
+	switch state := conn.GetState(); state {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		log.M(util.ModuleName).Debugf("drop %s connection of servant %s", state, wid)
+		wa.connMutex.Lock()
+		if wa.conns[wid] == conn {
+			delete(wa.conns, wid)
+		}
+		wa.connMutex.Unlock()
+		conn.Close()
+	}
+}
+
+// ConnStates return connection states of servants
+func (wa *servantAccessor) ConnStates() map[string]connectivity.State {
+	wa.connMutex.Lock()
+	defer wa.connMutex.Unlock()
+	states := make(map[string]connectivity.State)
+	for wid, conn := range wa.conns {
+		states[wid] = conn.GetState()
+	}
+	return states
+}
+
+// ConnStates return states of connections master keeps to servants, nil if master is not running
+func (m *Master) ConnStates() map[string]connectivity.State {
+	m.round.Lock()
+	defer m.round.Unlock()
+	if m.sa == nil {
+		return nil
+	}
+	return m.sa.ConnStates()
+}
+
+// evict close connection of servant leaving cluster
+func (wa *servantAccessor) evict(wid string) {
+	wa.connMutex.Lock()
+	conn, ok := wa.conns[wid]
+	delete(wa.conns, wid)
+	wa.connMutex.Unlock()
+	wa.forget(wid)
+	if ok {
+		log.M(util.ModuleName).Debugf("close connection of servant %s", wid)
+		conn.Close()
+	}
+}
+
+func (wa *servantAccessor) evictExcept(alive map[string]bool) {
+	wa.connMutex.Lock()
+	var gone []string
+	for wid := range wa.conns {
+		if !alive[wid] {
+			gone = append(gone, wid)
+		}
+	}
+	wa.connMutex.Unlock()
+	wa.healthMutex.Lock()
+	for wid := range wa.health {
+		if !alive[wid] {
+			gone = append(gone, wid)
+		}
+	}
+	wa.healthMutex.Unlock()
+	for _, wid := range gone {
+		wa.evict(wid)
+	}
+}
+
+// Close close all cached connections
+func (wa *servantAccessor) Close() {
+	wa.evictExcept(nil)
+}
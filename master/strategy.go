@@ -0,0 +1,160 @@
+package master
+
+import (
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// DispatchContext is the input of one dispatch round
+type DispatchContext struct {
+	// full ticket catalog
+	Tickets tickets.Tickets
+	// live servants with their metadata and tickets they hold
+	Current *CurrentDispatch
+	// assignment committed by master in previous round, nil before the first round
+	Previous ServantPayloads
+	// rpc health of all live servants including unhealthy ones left out of Current
+	Health map[string]ServantHealth
+	// ticket id to servant which does not acknowledge it within AckTimeout
+	Unacked map[string]string
+}
+
+// DispatchStrategy decide new dispatch of tickets to servants
+type DispatchStrategy interface {
+	Dispatch(ctx *DispatchContext, newDis *NewDispatch) error
+}
+
+// DispatchStrategyFunc adapt a function to DispatchStrategy
+type DispatchStrategyFunc func(*DispatchContext, *NewDispatch) error
+
+func (f DispatchStrategyFunc) Dispatch(ctx *DispatchContext, newDis *NewDispatch) error {
+	return f(ctx, newDis)
+}
+
+// Middleware decorate a DispatchStrategy
+type Middleware func(DispatchStrategy) DispatchStrategy
+
+// Chain wrap strategy with middlewares, the first middleware is the outermost one
+func Chain(s DispatchStrategy, mws ...Middleware) DispatchStrategy {
+	for i := len(mws) - 1; i >= 0; i-- {
+		s = mws[i](s)
+	}
+	return s
+}
+
+// TicketsStrategy adapt built-in dispatch such as ConservativeAverageDispatch to DispatchStrategy
+func TicketsStrategy(f func(tickets.Tickets, *CurrentDispatch, *NewDispatch) error) DispatchStrategy {
+	return DispatchStrategyFunc(func(ctx *DispatchContext, newDis *NewDispatch) error {
+		return f(ctx.Tickets, ctx.Current, newDis)
+	})
+}
+
+// HandlerStrategy adapt DispatchHandler to DispatchStrategy
+func HandlerStrategy(h DispatchHandler) DispatchStrategy {
+	return DispatchStrategyFunc(func(ctx *DispatchContext, newDis *NewDispatch) error {
+		return h(ctx.Current, newDis)
+	})
+}
+
+// ConstraintMiddleware apply constraints to the result of strategy
+func ConstraintMiddleware(cs ...Constraint) Middleware {
+	return func(next DispatchStrategy) DispatchStrategy {
+		return DispatchStrategyFunc(func(ctx *DispatchContext, newDis *NewDispatch) error {
+			if err := next.Dispatch(ctx, newDis); err != nil {
+				return err
+			}
+			return ApplyConstraints(ctx.Current, newDis, cs...)
+		})
+	}
+}
+
+// ChurnLimitMiddleware limit ticket moves of strategy per round
+func ChurnLimitMiddleware(budget ChurnBudget) Middleware {
+	return func(next DispatchStrategy) DispatchStrategy {
+		return DispatchStrategyFunc(func(ctx *DispatchContext, newDis *NewDispatch) error {
+			oldOwners := ticketOwners(ctx.Current.ServantPayloads)
+			if err := next.Dispatch(ctx, newDis); err != nil {
+				return err
+			}
+			applyChurnBudget(oldOwners, newDis, budget)
+			return nil
+		})
+	}
+}
+
+// PinningMiddleware force tickets to pinned servants, pins is ticket id to servant id and read every round,
+// pin of absent servant is ignored
+func PinningMiddleware(pins func() map[string]string) Middleware {
+	return func(next DispatchStrategy) DispatchStrategy {
+		return DispatchStrategyFunc(func(ctx *DispatchContext, newDis *NewDispatch) error {
+			if err := next.Dispatch(ctx, newDis); err != nil {
+				return err
+			}
+			pinM := pins()
+			if len(pinM) == 0 {
+				return nil
+			}
+			catalog := make(map[string]tickets.Ticket)
+			for _, tk := range ctx.Tickets {
+				catalog[tk.ID] = tk
+			}
+			idx := payloadIndex(newDis.ServantPayloads)
+			var unassigned tickets.Tickets
+			for _, tk := range newDis.Unassigned {
+				if sid, ok := pinM[tk.ID]; ok {
+					if _, ok = idx[sid]; ok {
+						catalog[tk.ID] = tk
+						continue
+					}
+				}
+				unassigned = append(unassigned, tk)
+			}
+			newDis.Unassigned = unassigned
+			for i := range newDis.ServantPayloads {
+				p := &newDis.ServantPayloads[i]
+				var kept tickets.Tickets
+				for _, tk := range p.Tickets {
+					if sid, ok := pinM[tk.ID]; ok && sid != p.ServantID {
+						if _, ok = idx[sid]; ok {
+							catalog[tk.ID] = tk
+							continue
+						}
+					}
+					kept = append(kept, tk)
+				}
+				p.Tickets = kept
+			}
+			owners := ticketOwners(newDis.ServantPayloads)
+			for id, sid := range pinM {
+				tk, ok := catalog[id]
+				if i, alive := idx[sid]; ok && alive && owners[id] != sid {
+					newDis.ServantPayloads[i].Tickets = appendTicket(newDis.ServantPayloads[i].Tickets, tk)
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// LoggingMiddleware log current and new dispatch of every round
+func LoggingMiddleware() Middleware {
+	return func(next DispatchStrategy) DispatchStrategy {
+		return DispatchStrategyFunc(func(ctx *DispatchContext, newDis *NewDispatch) error {
+			for _, s := range ctx.Current.ServantPayloads {
+				log.M(util.ModuleName).Infof("current servant %s tickets: %s", s.ServantID, s.Tickets.Summary())
+			}
+			if err := next.Dispatch(ctx, newDis); err != nil {
+				log.M(util.ModuleName).Errorf("dispatch fail:%v", err)
+				return err
+			}
+			for _, s := range newDis.ServantPayloads {
+				log.M(util.ModuleName).Infof("new servant %s tickets: %s", s.ServantID, s.Tickets.Summary())
+			}
+			if len(newDis.Unassigned) > 0 {
+				log.M(util.ModuleName).Infof("unassigned tickets: %s", newDis.Unassigned.Summary())
+			}
+			return nil
+		})
+	}
+}
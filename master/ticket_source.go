@@ -0,0 +1,106 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// TicketSource provide the full ticket catalog to master
+type TicketSource interface {
+	Tickets() (tickets.Tickets, error)
+	// Watch notify catalog changes to notifyC until closeC is closed
+	Watch(notifyC chan<- struct{}, closeC <-chan struct{}) error
+}
+
+// TicketsFunc adapt a loader function to TicketSource which never notifies changes
+type TicketsFunc func() (tickets.Tickets, error)
+
+func (f TicketsFunc) Tickets() (tickets.Tickets, error) {
+	return f()
+}
+
+func (f TicketsFunc) Watch(notifyC chan<- struct{}, closeC <-chan struct{}) error {
+	return nil
+}
+
+// EtcdTicketSource read tickets from <prefix>/tickets/ key range, key is ticket id and value is json encoded ticket
+type EtcdTicketSource struct {
+	cli *clientv3.Client
+	key string
+}
+
+func NewEtcdTicketSource(cli *clientv3.Client, prefix string) *EtcdTicketSource {
+	return &EtcdTicketSource{
+		cli: cli,
+		key: util.TicketKey(prefix) + "/",
+	}
+}
+
+func (s *EtcdTicketSource) Tickets() (tickets.Tickets, error) {
+	resp, err := s.cli.Get(context.Background(), s.key, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var tks tickets.Tickets
+	for _, kv := range resp.Kvs {
+		var tk tickets.Ticket
+		if err = json.Unmarshal(kv.Value, &tk); err != nil {
+			log.M(util.ModuleName).Warningf("skip bad ticket %s:%v", string(kv.Key), err)
+			continue
+		}
+		if tk.ID == "" {
+			tk.ID = strings.TrimPrefix(string(kv.Key), s.key)
+		}
+		tks = append(tks, tk)
+	}
+	return tks, nil
+}
+
+func (s *EtcdTicketSource) Watch(notifyC chan<- struct{}, closeC <-chan struct{}) error {
+	wchan := s.cli.Watch(context.Background(), s.key, clientv3.WithPrefix())
+	go func() {
+		for {
+			select {
+			case <-closeC:
+				log.M(util.ModuleName).Debug("ticket watch is closed.")
+				return
+			case wr := <-wchan:
+				if wr.Canceled {
+					log.M(util.ModuleName).Debug("ticket watch is canceled.")
+					return
+				} else if wr.Created {
+					log.M(util.ModuleName).Debug("ticket watch is created.")
+				} else {
+					log.M(util.ModuleName).Debug("tickets changed.")
+					select {
+					case notifyC <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Put add or update ticket
+func (s *EtcdTicketSource) Put(tk tickets.Ticket) error {
+	data, err := json.Marshal(tk)
+	if err != nil {
+		return err
+	}
+	_, err = s.cli.Put(context.Background(), s.key+tk.ID, string(data))
+	return err
+}
+
+// Delete remove ticket
+func (s *EtcdTicketSource) Delete(id string) error {
+	_, err := s.cli.Delete(context.Background(), s.key+id)
+	return err
+}
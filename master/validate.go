@@ -0,0 +1,116 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DispatchValidationError describe why a new dispatch is rejected
+type DispatchValidationError struct {
+	// ticket id to servants it is dispatched to
+	Duplicated map[string][]string
+	// servants not in current membership
+	UnknownServants []string
+	// servants given tickets with empty id
+	EmptyTicketIDs []string
+	// tickets of catalog, or held by current servants without catalog, neither dispatched
+	// nor reported in NewDispatch.Unassigned
+	Dropped []string
+}
+
+func (e *DispatchValidationError) Error() string {
+	var msgs []string
+	if len(e.Duplicated) > 0 {
+		var ids []string
+		for id := range e.Duplicated {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			msgs = append(msgs, fmt.Sprintf("ticket %s dispatched to %s", id, strings.Join(e.Duplicated[id], ",")))
+		}
+	}
+	if len(e.UnknownServants) > 0 {
+		msgs = append(msgs, fmt.Sprintf("unknown servants [%s]", strings.Join(e.UnknownServants, ",")))
+	}
+	if len(e.EmptyTicketIDs) > 0 {
+		msgs = append(msgs, fmt.Sprintf("empty ticket id on servants [%s]", strings.Join(e.EmptyTicketIDs, ",")))
+	}
+	if len(e.Dropped) > 0 {
+		msgs = append(msgs, fmt.Sprintf("dropped tickets [%s]", strings.Join(e.Dropped, ",")))
+	}
+	return "invalid dispatch: " + strings.Join(msgs, "; ")
+}
+
+// ValidateDispatch check new dispatch against current membership and ticket catalog,
+// without catalog tickets held by current servants are checked for dropping, so DispatchHandler retiring
+// a ticket reports it in NewDispatch.Unassigned, return *DispatchValidationError if invalid
+func ValidateDispatch(ctx *DispatchContext, newDis *NewDispatch) error {
+	e := &DispatchValidationError{Duplicated: make(map[string][]string)}
+	members := make(map[string]bool)
+	if ctx.Current != nil {
+		for _, p := range ctx.Current.ServantPayloads {
+			members[p.ServantID] = true
+		}
+	}
+	owners := make(map[string][]string)
+	for _, p := range newDis.ServantPayloads {
+		if !members[p.ServantID] {
+			e.UnknownServants = append(e.UnknownServants, p.ServantID)
+		}
+		var emptyID bool
+		for _, tk := range p.Tickets {
+			if tk.ID == "" {
+				emptyID = true
+				continue
+			}
+			owners[tk.ID] = append(owners[tk.ID], p.ServantID)
+		}
+		if emptyID {
+			e.EmptyTicketIDs = append(e.EmptyTicketIDs, p.ServantID)
+		}
+	}
+	for id, sids := range owners {
+		if len(sids) > 1 {
+			e.Duplicated[id] = sids
+		}
+	}
+	universe := ctx.Tickets
+	if universe == nil && ctx.Current != nil {
+		for _, p := range ctx.Current.ServantPayloads {
+			universe = append(universe, p.Tickets...)
+		}
+	}
+	// nowhere to dispatch without servants
+	if len(members) > 0 {
+		unassigned := make(map[string]bool)
+		for _, tk := range newDis.Unassigned {
+			unassigned[tk.ID] = true
+		}
+		seen := make(map[string]bool)
+		for _, tk := range universe {
+			if _, ok := owners[tk.ID]; !ok && !unassigned[tk.ID] && !seen[tk.ID] {
+				e.Dropped = append(e.Dropped, tk.ID)
+			}
+			seen[tk.ID] = true
+		}
+		sort.Strings(e.Dropped)
+	}
+	if len(e.Duplicated) == 0 && len(e.UnknownServants) == 0 && len(e.EmptyTicketIDs) == 0 && len(e.Dropped) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ValidationMiddleware reject invalid result of strategy
+func ValidationMiddleware() Middleware {
+	return func(next DispatchStrategy) DispatchStrategy {
+		return DispatchStrategyFunc(func(ctx *DispatchContext, newDis *NewDispatch) error {
+			if err := next.Dispatch(ctx, newDis); err != nil {
+				return err
+			}
+			return ValidateDispatch(ctx, newDis)
+		})
+	}
+}
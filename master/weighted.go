@@ -0,0 +1,97 @@
+package master
+
+import (
+	"sort"
+
+	"github.com/qjpcpu/servant-cluster/tickets"
+)
+
+// WeightedDispatch dispatch tickets in proportion to servant weights reported by tickets.WeightedSysInfoGetter,
+// servants without valid weight are treated as weight 1
+func WeightedDispatch(tks tickets.Tickets, last *CurrentDispatch, newDis *NewDispatch) error {
+	if len(last.ServantPayloads) == 0 {
+		return nil
+	}
+	payloads := make(ServantPayloads, len(last.ServantPayloads))
+	copy(payloads, last.ServantPayloads)
+	sort.Sort(payloads)
+	var weights []int
+	for _, p := range payloads {
+		weights = append(weights, ServantWeight(p))
+	}
+	quotas := weightedQuotas(len(tks), weights)
+
+	ticketMap := make(map[string]tickets.Ticket)
+	for _, tk := range tks {
+		ticketMap[tk.ID] = tk
+	}
+	var newPayloads ServantPayloads
+	for i, lastp := range payloads {
+		np := ServantPayload{ServantID: lastp.ServantID}
+		for _, tk := range lastp.Tickets {
+			if len(np.Tickets) >= quotas[i] {
+				break
+			}
+			if nt, ok := ticketMap[tk.ID]; ok {
+				np.Tickets = append(np.Tickets, nt)
+				delete(ticketMap, tk.ID)
+			}
+		}
+		newPayloads = append(newPayloads, np)
+	}
+	var remainTickets tickets.Tickets
+	for _, tk := range ticketMap {
+		remainTickets = append(remainTickets, tk)
+	}
+	sort.Sort(remainTickets)
+	for i := range newPayloads {
+		diff := quotas[i] - len(newPayloads[i].Tickets)
+		if diff > len(remainTickets) {
+			diff = len(remainTickets)
+		}
+		if diff > 0 {
+			newPayloads[i].Tickets = append(newPayloads[i].Tickets, remainTickets[:diff]...)
+			remainTickets = remainTickets[diff:]
+		}
+	}
+	newDis.ServantPayloads = newPayloads
+	return nil
+}
+
+// ServantWeight return weight reported by servant, 1 if not reported
+func ServantWeight(p ServantPayload) int {
+	st, err := tickets.ParseServantStats(p.SystemStats)
+	if err != nil || st.Weight <= 0 {
+		return 1
+	}
+	return st.Weight
+}
+
+// weightedQuotas split total by weights with largest remainder method
+func weightedQuotas(total int, weights []int) []int {
+	var sum int
+	for _, w := range weights {
+		sum += w
+	}
+	quotas := make([]int, len(weights))
+	if sum == 0 {
+		return quotas
+	}
+	remains := make([]int, len(weights))
+	var assigned int
+	for i, w := range weights {
+		quotas[i] = total * w / sum
+		remains[i] = total * w % sum
+		assigned += quotas[i]
+	}
+	idx := make([]int, len(weights))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return remains[idx[i]] > remains[idx[j]] })
+	for i := 0; assigned < total; i++ {
+		quotas[idx[i%len(idx)]]++
+		assigned++
+	}
+	return quotas
+}
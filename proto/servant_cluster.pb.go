@@ -22,6 +22,49 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+// lifecycle of a ticket on servant
+type TicketState int32
+
+const (
+	// received from master, no worker has started it yet
+	TicketState_TICKET_ASSIGNED TicketState = 0
+	// started by a worker, not running now
+	TicketState_TICKET_ACKNOWLEDGED TicketState = 1
+	TicketState_TICKET_RUNNING      TicketState = 2
+	// last run failed
+	TicketState_TICKET_FAILED TicketState = 3
+	// removed by master while its handler is still running
+	TicketState_TICKET_REVOKED TicketState = 4
+	// retry attempts ran out, not run until master reassigns it
+	TicketState_TICKET_DEAD_LETTER TicketState = 5
+)
+
+var TicketState_name = map[int32]string{
+	0: "TICKET_ASSIGNED",
+	1: "TICKET_ACKNOWLEDGED",
+	2: "TICKET_RUNNING",
+	3: "TICKET_FAILED",
+	4: "TICKET_REVOKED",
+	5: "TICKET_DEAD_LETTER",
+}
+
+var TicketState_value = map[string]int32{
+	"TICKET_ASSIGNED":     0,
+	"TICKET_ACKNOWLEDGED": 1,
+	"TICKET_RUNNING":      2,
+	"TICKET_FAILED":       3,
+	"TICKET_REVOKED":      4,
+	"TICKET_DEAD_LETTER":  5,
+}
+
+func (x TicketState) String() string {
+	return proto.EnumName(TicketState_name, int32(x))
+}
+
+func (TicketState) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_d975c2f921663dbb, []int{0}
+}
+
 type Empty struct {
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
@@ -54,12 +97,16 @@ func (m *Empty) XXX_DiscardUnknown() {
 var xxx_messageInfo_Empty proto.InternalMessageInfo
 
 type TicketInfo struct {
-	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Type                 int32    `protobuf:"varint,2,opt,name=type,proto3" json:"type,omitempty"`
-	Content              []byte   `protobuf:"bytes,3,opt,name=content,proto3" json:"content,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Id                   string            `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Type                 int32             `protobuf:"varint,2,opt,name=type,proto3" json:"type,omitempty"`
+	Content              []byte            `protobuf:"bytes,3,opt,name=content,proto3" json:"content,omitempty"`
+	Labels               map[string]string `protobuf:"bytes,4,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Priority             int32             `protobuf:"varint,5,opt,name=priority,proto3" json:"priority,omitempty"`
+	Group                string            `protobuf:"bytes,6,opt,name=group,proto3" json:"group,omitempty"`
+	AntiAffinity         string            `protobuf:"bytes,7,opt,name=anti_affinity,json=antiAffinity,proto3" json:"anti_affinity,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *TicketInfo) Reset()         { *m = TicketInfo{} }
@@ -108,6 +155,108 @@ func (m *TicketInfo) GetContent() []byte {
 	return nil
 }
 
+func (m *TicketInfo) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *TicketInfo) GetPriority() int32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *TicketInfo) GetGroup() string {
+	if m != nil {
+		return m.Group
+	}
+	return ""
+}
+
+func (m *TicketInfo) GetAntiAffinity() string {
+	if m != nil {
+		return m.AntiAffinity
+	}
+	return ""
+}
+
+type TicketStatus struct {
+	Id    string      `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	State TicketState `protobuf:"varint,2,opt,name=state,proto3,enum=proto.TicketState" json:"state,omitempty"`
+	// nanoseconds since last state change
+	Elapsed int64 `protobuf:"varint,3,opt,name=elapsed,proto3" json:"elapsed,omitempty"`
+	// error of last failed run
+	Error string `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	// consecutive failed runs
+	Attempts             int32    `protobuf:"varint,5,opt,name=attempts,proto3" json:"attempts,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TicketStatus) Reset()         { *m = TicketStatus{} }
+func (m *TicketStatus) String() string { return proto.CompactTextString(m) }
+func (*TicketStatus) ProtoMessage()    {}
+func (*TicketStatus) Descriptor() ([]byte, []int) {
+	return fileDescriptor_d975c2f921663dbb, []int{2}
+}
+
+func (m *TicketStatus) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TicketStatus.Unmarshal(m, b)
+}
+func (m *TicketStatus) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TicketStatus.Marshal(b, m, deterministic)
+}
+func (m *TicketStatus) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TicketStatus.Merge(m, src)
+}
+func (m *TicketStatus) XXX_Size() int {
+	return xxx_messageInfo_TicketStatus.Size(m)
+}
+func (m *TicketStatus) XXX_DiscardUnknown() {
+	xxx_messageInfo_TicketStatus.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TicketStatus proto.InternalMessageInfo
+
+func (m *TicketStatus) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *TicketStatus) GetState() TicketState {
+	if m != nil {
+		return m.State
+	}
+	return TicketState_TICKET_ASSIGNED
+}
+
+func (m *TicketStatus) GetElapsed() int64 {
+	if m != nil {
+		return m.Elapsed
+	}
+	return 0
+}
+
+func (m *TicketStatus) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *TicketStatus) GetAttempts() int32 {
+	if m != nil {
+		return m.Attempts
+	}
+	return 0
+}
+
 type SystemInfo struct {
 	Stats                []byte   `protobuf:"bytes,1,opt,name=stats,proto3" json:"stats,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -119,7 +268,7 @@ func (m *SystemInfo) Reset()         { *m = SystemInfo{} }
 func (m *SystemInfo) String() string { return proto.CompactTextString(m) }
 func (*SystemInfo) ProtoMessage()    {}
 func (*SystemInfo) Descriptor() ([]byte, []int) {
-	return fileDescriptor_d975c2f921663dbb, []int{2}
+	return fileDescriptor_d975c2f921663dbb, []int{3}
 }
 
 func (m *SystemInfo) XXX_Unmarshal(b []byte) error {
@@ -148,18 +297,25 @@ func (m *SystemInfo) GetStats() []byte {
 }
 
 type TicketsInfo struct {
-	TicketsInfo          []*TicketInfo `protobuf:"bytes,1,rep,name=tickets_info,json=ticketsInfo,proto3" json:"tickets_info,omitempty"`
-	SysInfo              *SystemInfo   `protobuf:"bytes,2,opt,name=sys_info,json=sysInfo,proto3" json:"sys_info,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
-	XXX_unrecognized     []byte        `json:"-"`
-	XXX_sizecache        int32         `json:"-"`
+	TicketsInfo []*TicketInfo `protobuf:"bytes,1,rep,name=tickets_info,json=ticketsInfo,proto3" json:"tickets_info,omitempty"`
+	SysInfo     *SystemInfo   `protobuf:"bytes,2,opt,name=sys_info,json=sysInfo,proto3" json:"sys_info,omitempty"`
+	// ids of tickets whose handler is running
+	RunningIds []string `protobuf:"bytes,3,rep,name=running_ids,json=runningIds,proto3" json:"running_ids,omitempty"`
+	// identity and election epoch of master, servant rejects tickets from master with stale epoch
+	MasterId string `protobuf:"bytes,4,opt,name=master_id,json=masterId,proto3" json:"master_id,omitempty"`
+	Epoch    int64  `protobuf:"varint,5,opt,name=epoch,proto3" json:"epoch,omitempty"`
+	// states of assigned and revoked tickets
+	TicketStates         []*TicketStatus `protobuf:"bytes,6,rep,name=ticket_states,json=ticketStates,proto3" json:"ticket_states,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
 }
 
 func (m *TicketsInfo) Reset()         { *m = TicketsInfo{} }
 func (m *TicketsInfo) String() string { return proto.CompactTextString(m) }
 func (*TicketsInfo) ProtoMessage()    {}
 func (*TicketsInfo) Descriptor() ([]byte, []int) {
-	return fileDescriptor_d975c2f921663dbb, []int{3}
+	return fileDescriptor_d975c2f921663dbb, []int{4}
 }
 
 func (m *TicketsInfo) XXX_Unmarshal(b []byte) error {
@@ -194,9 +350,40 @@ func (m *TicketsInfo) GetSysInfo() *SystemInfo {
 	return nil
 }
 
+func (m *TicketsInfo) GetRunningIds() []string {
+	if m != nil {
+		return m.RunningIds
+	}
+	return nil
+}
+
+func (m *TicketsInfo) GetMasterId() string {
+	if m != nil {
+		return m.MasterId
+	}
+	return ""
+}
+
+func (m *TicketsInfo) GetEpoch() int64 {
+	if m != nil {
+		return m.Epoch
+	}
+	return 0
+}
+
+func (m *TicketsInfo) GetTicketStates() []*TicketStatus {
+	if m != nil {
+		return m.TicketStates
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("proto.TicketState", TicketState_name, TicketState_value)
 	proto.RegisterType((*Empty)(nil), "proto.Empty")
 	proto.RegisterType((*TicketInfo)(nil), "proto.TicketInfo")
+	proto.RegisterMapType((map[string]string)(nil), "proto.TicketInfo.LabelsEntry")
+	proto.RegisterType((*TicketStatus)(nil), "proto.TicketStatus")
 	proto.RegisterType((*SystemInfo)(nil), "proto.SystemInfo")
 	proto.RegisterType((*TicketsInfo)(nil), "proto.TicketsInfo")
 }
@@ -204,23 +391,44 @@ func init() {
 func init() { proto.RegisterFile("servant_cluster.proto", fileDescriptor_d975c2f921663dbb) }
 
 var fileDescriptor_d975c2f921663dbb = []byte{
-	// 253 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x90, 0x51, 0x4b, 0xc3, 0x30,
-	0x14, 0x85, 0xd7, 0xce, 0x5a, 0xbd, 0x2d, 0xa2, 0x41, 0x21, 0xec, 0xa9, 0xe4, 0xa9, 0x0f, 0x32,
-	0x64, 0xfa, 0x13, 0x14, 0xd1, 0xc7, 0xcc, 0xf7, 0x51, 0xbb, 0x0c, 0x83, 0x2e, 0xa9, 0xbd, 0xd7,
-	0x41, 0xfe, 0xbd, 0xec, 0xa6, 0x52, 0x07, 0x7b, 0x4a, 0x0e, 0x9c, 0xef, 0x9c, 0xc3, 0x85, 0x1b,
-	0x34, 0xfd, 0xae, 0x71, 0xb4, 0x6a, 0xbf, 0x7e, 0x90, 0x4c, 0x3f, 0xef, 0x7a, 0x4f, 0x5e, 0x64,
-	0xfc, 0xa8, 0x1c, 0xb2, 0xa7, 0x6d, 0x47, 0x41, 0xbd, 0x02, 0xbc, 0xd9, 0xf6, 0xd3, 0xd0, 0x8b,
-	0xdb, 0x78, 0x71, 0x01, 0xa9, 0x5d, 0xcb, 0xa4, 0x4a, 0xea, 0x73, 0x9d, 0xda, 0xb5, 0x10, 0x70,
-	0x42, 0xa1, 0x33, 0x32, 0xad, 0x92, 0x3a, 0xd3, 0xfc, 0x17, 0x12, 0xf2, 0xd6, 0x3b, 0x32, 0x8e,
-	0xe4, 0xb4, 0x4a, 0xea, 0x52, 0xff, 0x49, 0xa5, 0x00, 0x96, 0x01, 0xc9, 0x6c, 0x39, 0xeb, 0x1a,
-	0x32, 0xa4, 0x86, 0x90, 0xe3, 0x4a, 0x1d, 0x85, 0xfa, 0x86, 0x22, 0xf6, 0x21, 0x9b, 0x1e, 0xa0,
-	0xa4, 0x28, 0x57, 0xd6, 0x6d, 0xbc, 0x4c, 0xaa, 0x69, 0x5d, 0x2c, 0xae, 0xe2, 0xd8, 0xf9, 0xb8,
-	0x4c, 0x17, 0xf4, 0x8f, 0xba, 0x85, 0x33, 0x0c, 0x03, 0xb1, 0x9f, 0x36, 0x12, 0x63, 0xbf, 0xce,
-	0x31, 0xb0, 0x7b, 0xb1, 0x83, 0xcb, 0x18, 0xf4, 0x68, 0xb1, 0x6b, 0xa8, 0xfd, 0x30, 0xbd, 0xb8,
-	0x03, 0x78, 0x36, 0x34, 0x2c, 0x11, 0xe5, 0x40, 0xf3, 0x49, 0x66, 0xe2, 0xa0, 0x9d, 0x33, 0xd4,
-	0x64, 0x4f, 0x2c, 0x47, 0xe2, 0x88, 0x67, 0x76, 0x90, 0xa2, 0x26, 0xef, 0xa7, 0x2c, 0xef, 0x7f,
-	0x03, 0x00, 0x00, 0xff, 0xff, 0xda, 0xcb, 0x58, 0x0d, 0x8a, 0x01, 0x00, 0x00,
+	// 583 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x53, 0xd1, 0x6e, 0xd3, 0x30,
+	0x14, 0x5d, 0x9a, 0xa6, 0x5d, 0x6f, 0xb3, 0x91, 0x79, 0x03, 0xa2, 0x22, 0x44, 0x15, 0x5e, 0x2a,
+	0x84, 0x26, 0x34, 0x40, 0x1a, 0xbc, 0x55, 0x8b, 0xa9, 0xa2, 0x55, 0x9d, 0xe4, 0x16, 0x78, 0x8c,
+	0xb2, 0xd6, 0xdd, 0xac, 0xb5, 0x49, 0x64, 0xdf, 0x4c, 0xca, 0x4f, 0xf0, 0x02, 0xff, 0x0b, 0x8a,
+	0x9d, 0xae, 0x9b, 0xca, 0x53, 0x73, 0x8e, 0xef, 0xf1, 0x3d, 0xf7, 0x5c, 0x17, 0x9e, 0x2b, 0x2e,
+	0xef, 0x93, 0x14, 0xe3, 0xf9, 0xaa, 0x50, 0xc8, 0xe5, 0x69, 0x2e, 0x33, 0xcc, 0x88, 0xa3, 0x7f,
+	0x82, 0x36, 0x38, 0x74, 0x9d, 0x63, 0x19, 0xfc, 0x6e, 0x00, 0xcc, 0xc4, 0xfc, 0x8e, 0x63, 0x94,
+	0x2e, 0x33, 0x72, 0x08, 0x0d, 0xb1, 0xf0, 0xad, 0xbe, 0x35, 0xe8, 0xb0, 0x86, 0x58, 0x10, 0x02,
+	0x4d, 0x2c, 0x73, 0xee, 0x37, 0xfa, 0xd6, 0xc0, 0x61, 0xfa, 0x9b, 0xf8, 0xd0, 0x9e, 0x67, 0x29,
+	0xf2, 0x14, 0x7d, 0xbb, 0x6f, 0x0d, 0x5c, 0xb6, 0x81, 0xe4, 0x33, 0xb4, 0x56, 0xc9, 0x35, 0x5f,
+	0x29, 0xbf, 0xd9, 0xb7, 0x07, 0xdd, 0xb3, 0xd7, 0xa6, 0xe9, 0xe9, 0xb6, 0xc1, 0xe9, 0x58, 0x9f,
+	0xd3, 0x14, 0x65, 0xc9, 0xea, 0x62, 0xd2, 0x83, 0xfd, 0x5c, 0x8a, 0x4c, 0x0a, 0x2c, 0x7d, 0x47,
+	0x37, 0x7a, 0xc0, 0xe4, 0x04, 0x9c, 0x1b, 0x99, 0x15, 0xb9, 0xdf, 0xd2, 0x9e, 0x0c, 0x20, 0x6f,
+	0xe1, 0x20, 0x49, 0x51, 0xc4, 0xc9, 0x72, 0x29, 0xd2, 0x4a, 0xd6, 0xd6, 0xa7, 0x6e, 0x45, 0x0e,
+	0x6b, 0xae, 0xf7, 0x05, 0xba, 0x8f, 0xba, 0x11, 0x0f, 0xec, 0x3b, 0x5e, 0xd6, 0xb3, 0x55, 0x9f,
+	0xd5, 0xdd, 0xf7, 0xc9, 0xaa, 0x30, 0xd3, 0x75, 0x98, 0x01, 0x5f, 0x1b, 0xe7, 0x56, 0xf0, 0xc7,
+	0x02, 0xd7, 0x98, 0x9e, 0x62, 0x82, 0x85, 0xda, 0xc9, 0x65, 0x00, 0x8e, 0xc2, 0x04, 0x8d, 0xf4,
+	0xf0, 0x8c, 0x3c, 0x19, 0xb4, 0xd2, 0x70, 0x66, 0x0a, 0xaa, 0xb4, 0xf8, 0x2a, 0xc9, 0x15, 0x5f,
+	0xe8, 0xb4, 0x6c, 0xb6, 0x81, 0x55, 0x7b, 0x2e, 0x65, 0x26, 0xfd, 0xa6, 0x69, 0xaf, 0x41, 0x15,
+	0x46, 0x82, 0xc8, 0xd7, 0x39, 0xaa, 0x4d, 0x18, 0x1b, 0x1c, 0x04, 0x00, 0xd3, 0x52, 0x21, 0x5f,
+	0xeb, 0x5d, 0x9d, 0x18, 0x0f, 0x4a, 0xdb, 0x72, 0x4d, 0x3f, 0x15, 0xfc, 0xb5, 0xa0, 0x6b, 0x6c,
+	0x28, 0x5d, 0xf5, 0x09, 0x5c, 0x34, 0x30, 0x16, 0xe9, 0x32, 0xf3, 0x2d, 0xbd, 0x99, 0xa3, 0x9d,
+	0xcd, 0xb0, 0x2e, 0x3e, 0x52, 0xbd, 0x87, 0x7d, 0x55, 0xd6, 0x8a, 0x6a, 0xc4, 0xad, 0x62, 0x6b,
+	0x80, 0xb5, 0x55, 0x69, 0xaa, 0xdf, 0x40, 0x57, 0x16, 0x69, 0x2a, 0xd2, 0x9b, 0x58, 0x2c, 0x94,
+	0x6f, 0xf7, 0xed, 0x41, 0x87, 0x41, 0x4d, 0x45, 0x0b, 0x45, 0x5e, 0x41, 0x67, 0x9d, 0x54, 0xaf,
+	0x30, 0x16, 0x8b, 0x7a, 0xdc, 0x7d, 0x43, 0x44, 0x26, 0x87, 0x3c, 0x9b, 0xdf, 0xea, 0x71, 0x6d,
+	0x66, 0x00, 0x39, 0x87, 0x03, 0x63, 0x28, 0xd6, 0x39, 0x2a, 0xbf, 0xa5, 0x8d, 0x1f, 0xef, 0x24,
+	0x5d, 0x28, 0xe6, 0xe2, 0x03, 0xe2, 0xea, 0xdd, 0xaf, 0x87, 0x04, 0x34, 0x41, 0x8e, 0xe1, 0xd9,
+	0x2c, 0xba, 0xb8, 0xa4, 0xb3, 0x78, 0x38, 0x9d, 0x46, 0xa3, 0x09, 0x0d, 0xbd, 0x3d, 0xf2, 0x12,
+	0x8e, 0x37, 0xe4, 0xc5, 0xe5, 0xe4, 0xea, 0xe7, 0x98, 0x86, 0x23, 0x1a, 0x7a, 0x16, 0x21, 0x70,
+	0x58, 0x1f, 0xb0, 0xef, 0x93, 0x49, 0x34, 0x19, 0x79, 0x0d, 0x72, 0x04, 0x07, 0x35, 0xf7, 0x6d,
+	0x18, 0x8d, 0x69, 0xe8, 0xd9, 0x8f, 0xcb, 0xe8, 0x8f, 0xab, 0x4b, 0x1a, 0x7a, 0x4d, 0xf2, 0x02,
+	0x48, 0xcd, 0x85, 0x74, 0x18, 0xc6, 0x63, 0x3a, 0x9b, 0x51, 0xe6, 0x39, 0x67, 0xf7, 0xe0, 0x19,
+	0x3f, 0xa1, 0x50, 0x79, 0x82, 0xf3, 0x5b, 0x2e, 0xc9, 0x07, 0x80, 0x11, 0xc7, 0x7a, 0x51, 0xc4,
+	0xad, 0xa7, 0xd2, 0xff, 0xc9, 0xde, 0xd3, 0xd7, 0xa4, 0x23, 0x0e, 0xf6, 0x2a, 0xc5, 0x74, 0xab,
+	0xf8, 0x4f, 0x4d, 0xef, 0xc9, 0x2d, 0xc1, 0xde, 0x75, 0x4b, 0xc3, 0x8f, 0xff, 0x06, 0x00, 0xd9,
+	0x76, 0x24, 0x35, 0x0b, 0x04, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
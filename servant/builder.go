@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
 	"go.etcd.io/etcd/clientv3"
 )
 
@@ -11,9 +12,11 @@ type ServantBuilder struct {
 	cli         *clientv3.Client
 	keyPrefix   string
 	wid         string
+	labels      map[string]string
 	workerNum   int
 	intervalSec time.Duration
-	jobHandler  ServantHandler
+	jobHandler  ContextHandler
+	ownHandler  OwnHandler
 	tq          *tickets.Queue
 }
 
@@ -31,7 +34,19 @@ func (wb *ServantBuilder) SetEtcdCli(cli *clientv3.Client) *ServantBuilder {
 }
 
 func (wb *ServantBuilder) SetServantHandler(sh ServantHandler) *ServantBuilder {
-	wb.jobHandler = sh
+	wb.jobHandler = sh.WithContext()
+	return wb
+}
+
+// SetOwnHandler switch pool to ownership mode, every assigned ticket is owned by its own goroutine until revoked
+func (wb *ServantBuilder) SetOwnHandler(h OwnHandler) *ServantBuilder {
+	wb.ownHandler = h
+	return wb
+}
+
+// SetContextHandler set handler which is interrupted by ticket revocation and pool stop
+func (wb *ServantBuilder) SetContextHandler(h ContextHandler) *ServantBuilder {
+	wb.jobHandler = h
 	return wb
 }
 func (wb *ServantBuilder) SetKeyPrefix(keyPrefix string) *ServantBuilder {
@@ -44,6 +59,12 @@ func (wb *ServantBuilder) SetServantID(wid string) *ServantBuilder {
 	wb.wid = wid
 	return wb
 }
+
+// SetLabels set labels advertised by servant, tickets only go to servants matching their labels under label dispatch
+func (wb *ServantBuilder) SetLabels(labels map[string]string) *ServantBuilder {
+	wb.labels = labels
+	return wb
+}
 func (wb *ServantBuilder) SetServantMaxNum(workerNum int) *ServantBuilder {
 	wb.workerNum = workerNum
 	return wb
@@ -62,7 +83,12 @@ func (wb *ServantBuilder) Run() *ServantPool {
 	if wb.intervalSec == 0 {
 		wb.intervalSec = 5
 	}
-	sp := newPool(wb.tq, wb.workerNum, wb.intervalSec, wb.jobHandler)
-	sp.startRegistProcess(wb.cli, wb.keyPrefix, wb.wid)
+	var sp *ServantPool
+	if wb.ownHandler != nil {
+		sp = newOwnerPool(wb.tq, wb.intervalSec, wb.ownHandler)
+	} else {
+		sp = newPool(wb.tq, wb.workerNum, wb.intervalSec, wb.jobHandler)
+	}
+	sp.startRegistProcess(wb.cli, wb.keyPrefix, util.ServantMeta{ID: wb.wid, Labels: wb.labels})
 	return sp
 }
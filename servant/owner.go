@@ -0,0 +1,126 @@
+package servant
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qjpcpu/log"
+	"github.com/qjpcpu/servant-cluster/tickets"
+	"github.com/qjpcpu/servant-cluster/util"
+)
+
+// OwnHandler own ticket until ctx is cancelled, it is called once when ticket is assigned and ctx is
+// cancelled when master revokes the ticket or pool stops, SolidTicket is owned again after schedule interval
+// if OwnHandler returns by itself, failures follow retry policy of ticket type
+type OwnHandler func(ctx context.Context, t tickets.Ticket) error
+
+// newOwnerPool start a goroutine owning every assigned ticket instead of a bounded worker pool
+func newOwnerPool(q *tickets.Queue, interval time.Duration, own OwnHandler) *ServantPool {
+	wp := &ServantPool{
+		mutex:                  new(sync.Mutex),
+		ownMutex:               new(sync.Mutex),
+		interval:               interval,
+		closeC:                 make(chan struct{}, 1),
+		requestMasterScheduleC: make(chan struct{}),
+		tq:                     q,
+		wg:                     new(sync.WaitGroup),
+		ownHandler:             own,
+		owned:                  make(map[string]*ownedTicket),
+	}
+	wp.ctx, wp.cancel = context.WithCancel(context.Background())
+	wp.wg.Add(1)
+	go func() {
+		defer wp.wg.Done()
+		for {
+			select {
+			case <-wp.closeC:
+				log.M(util.ModuleName).Info("owner goroutine exit.")
+				return
+			case t := <-q.RequestC():
+				wp.startOwn(t)
+			}
+		}
+	}()
+	return wp
+}
+
+// ownedTicket is the newest copy of an owned ticket, gen increases whenever Set pushes it again
+type ownedTicket struct {
+	ticket tickets.Ticket
+	gen    int
+}
+
+func (p *ServantPool) startOwn(t tickets.Ticket) {
+	p.ownMutex.Lock()
+	defer p.ownMutex.Unlock()
+	if o, ok := p.owned[t.ID]; ok {
+		// tickets are pushed again on every Set, remember the newest one for restart
+		o.ticket = t
+		o.gen++
+		return
+	}
+	if atomic.LoadInt32(&p.stopped) == 1 {
+		return
+	}
+	p.owned[t.ID] = &ownedTicket{ticket: t}
+	p.wg.Add(1)
+	go p.own(t, 0)
+}
+
+func (p *ServantPool) own(t tickets.Ticket, gen int) {
+	defer p.wg.Done()
+	log.M(util.ModuleName).Debugf("own ticket %s", t.ID)
+	ctx, ok := p.tq.BeginWork(p.ctx, t)
+	var err error
+	if ok {
+		err = p.ownHandler(ctx, t)
+		p.tq.EndWork(t, err)
+		if err != nil {
+			log.M(util.ModuleName).Debugf("own ticket %s fail:%v", t.ID, err)
+		}
+	}
+	p.ownMutex.Lock()
+	o := p.owned[t.ID]
+	if !ok || ctx.Err() != nil {
+		// superseded or revoked, a copy pushed by a newer Set meanwhile may be assigned again
+		if o.gen != gen && atomic.LoadInt32(&p.stopped) == 0 {
+			p.wg.Add(1)
+			go p.own(o.ticket, o.gen)
+		} else {
+			delete(p.owned, t.ID)
+		}
+		p.ownMutex.Unlock()
+		return
+	}
+	delete(p.owned, t.ID)
+	p.ownMutex.Unlock()
+	latest := o.ticket
+	if err != nil {
+		if p.tq.RecycleFailed(latest, p.interval) {
+			log.M(util.ModuleName).Warningf("ticket %s is dead lettered:%v", t.ID, err)
+		}
+		return
+	}
+	select {
+	case <-p.closeC:
+		return
+	case <-time.After(p.interval):
+	}
+	// dropped by queue if revoked
+	p.tq.Recycle(latest)
+}
+
+// OwnedIDs return ids of tickets owned now in ownership mode
+func (p *ServantPool) OwnedIDs() []string {
+	p.ownMutex.Lock()
+	defer p.ownMutex.Unlock()
+	var ids []string
+	for id := range p.owned {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
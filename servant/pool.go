@@ -2,6 +2,7 @@ package servant
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -23,13 +24,20 @@ type ServantPool struct {
 	idInc                  int32
 	closeC                 chan struct{}
 	requestMasterScheduleC chan struct{}
-	jobHandler             ServantHandler
+	jobHandler             ContextHandler
 	tq                     *tickets.Queue
-	stopped                int32
-	wg                     *sync.WaitGroup
+	// cancelled on stop to interrupt running handlers
+	ctx    context.Context
+	cancel context.CancelFunc
+	// ownership mode, owned is guarded by ownMutex as Stop holds mutex while waiting owners
+	ownMutex   *sync.Mutex
+	ownHandler OwnHandler
+	owned      map[string]*ownedTicket
+	stopped    int32
+	wg         *sync.WaitGroup
 }
 
-func newPool(q *tickets.Queue, maxW int, workIntervalSec time.Duration, jobHandler ServantHandler) *ServantPool {
+func newPool(q *tickets.Queue, maxW int, workIntervalSec time.Duration, jobHandler ContextHandler) *ServantPool {
 	wp := &ServantPool{
 		maxServant:             maxW,
 		mutex:                  new(sync.Mutex),
@@ -40,8 +48,9 @@ func newPool(q *tickets.Queue, maxW int, workIntervalSec time.Duration, jobHandl
 		tq:                     q,
 		wg:                     new(sync.WaitGroup),
 	}
+	wp.ctx, wp.cancel = context.WithCancel(context.Background())
+	wp.wg.Add(1)
 	go func() {
-		wp.wg.Add(1)
 		defer wp.wg.Done()
 		for {
 			select {
@@ -55,12 +64,12 @@ func newPool(q *tickets.Queue, maxW int, workIntervalSec time.Duration, jobHandl
 	}()
 	return wp
 }
-func (p *ServantPool) startRegistProcess(cli *clientv3.Client, keyf string, wid string) {
+func (p *ServantPool) startRegistProcess(cli *clientv3.Client, keyf string, meta util.ServantMeta) {
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
 		for {
-			p.registProcess(cli, keyf, wid)
+			p.registProcess(cli, keyf, meta)
 			select {
 			case <-p.closeC:
 				log.M(util.ModuleName).Info("regist goroutine exit.")
@@ -71,23 +80,27 @@ func (p *ServantPool) startRegistProcess(cli *clientv3.Client, keyf string, wid
 	}()
 }
 
-func (p *ServantPool) registProcess(cli *clientv3.Client, keyf string, wid string) error {
+func (p *ServantPool) registProcess(cli *clientv3.Client, keyf string, meta util.ServantMeta) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
 	session, err := concurrency.NewSession(cli, concurrency.WithTTL(10))
 	if err != nil {
 		return err
 	}
 	defer session.Close()
-	k := fmt.Sprintf("%s/%x/%s", util.ServantKey(keyf), session.Lease(), wid)
+	k := fmt.Sprintf("%s/%x/%s", util.ServantKey(keyf), session.Lease(), meta.ID)
 	log.M(util.ModuleName).Debugf("regist self to %s", k)
 	client := session.Client()
-	if _, err = client.Put(context.Background(), k, wid, clientv3.WithLease(session.Lease())); err != nil {
+	if _, err = client.Put(context.Background(), k, string(value), clientv3.WithLease(session.Lease())); err != nil {
 		return err
 	}
 HOLDPROCESS:
 	for {
 		select {
 		case <-p.requestMasterScheduleC:
-			client.Put(context.Background(), k, wid, clientv3.WithLease(session.Lease()))
+			client.Put(context.Background(), k, string(value), clientv3.WithLease(session.Lease()))
 			log.M(util.ModuleName).Debugf("%s request master reschedule", k)
 		case <-p.closeC:
 			break HOLDPROCESS
@@ -129,7 +142,7 @@ func (p *ServantPool) AddServant(n int) {
 		}
 		n -= len(p.silent)
 		for i := 0; i < n; i++ {
-			w := newServant(atomic.AddInt32(&p.idInc, 1), p.tq, p.interval, p.jobHandler)
+			w := newServant(p.ctx, atomic.AddInt32(&p.idInc, 1), p.tq, p.interval, p.jobHandler)
 			p.wg.Add(1)
 			go w.start(p.wg)
 			p.active = append(p.active, w)
@@ -178,6 +191,7 @@ func (p *ServantPool) Stop() {
 	if atomic.CompareAndSwapInt32(&p.stopped, 0, 1) {
 		p.mutex.Lock()
 		defer p.mutex.Unlock()
+		p.cancel()
 		for _, w := range p.active {
 			w.stop()
 		}
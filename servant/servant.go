@@ -1,6 +1,7 @@
 package servant
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -11,7 +12,8 @@ import (
 
 type srvt struct {
 	id       int32
-	handler  ServantHandler
+	ctx      context.Context
+	handler  ContextHandler
 	stopC    chan struct{}
 	silentC  chan struct{}
 	activeC  chan struct{}
@@ -19,9 +21,10 @@ type srvt struct {
 	tq       *tickets.Queue
 }
 
-func newServant(id int32, tq *tickets.Queue, intervalSec time.Duration, handler ServantHandler) *srvt {
+func newServant(ctx context.Context, id int32, tq *tickets.Queue, intervalSec time.Duration, handler ContextHandler) *srvt {
 	return &srvt{
 		id:       id,
+		ctx:      ctx,
 		stopC:    make(chan struct{}, 1),
 		silentC:  make(chan struct{}, 1),
 		handler:  handler,
@@ -53,9 +56,20 @@ func (w *srvt) start(wg *sync.WaitGroup) {
 	}
 }
 func (w *srvt) doSafeWork(t tickets.Ticket) {
-	defer w.tq.Recycle(t)
-	if err := w.handler(t); err != nil {
-		log.M(util.ModuleName).Debugf("[worker-%d] dowork fail:%v", w.id, err)
+	ctx, ok := w.tq.BeginWork(w.ctx, t)
+	if !ok {
+		// superseded by a newer Set, which queued the ticket again if still assigned
+		return
+	}
+	err := w.handler(ctx, t)
+	w.tq.EndWork(t, err)
+	if err == nil {
+		w.tq.Recycle(t)
+		return
+	}
+	log.M(util.ModuleName).Debugf("[worker-%d] dowork fail:%v", w.id, err)
+	if w.tq.RecycleFailed(t, 0) {
+		log.M(util.ModuleName).Warningf("[worker-%d] ticket %s is dead lettered:%v", w.id, t.ID, err)
 	}
 }
 
@@ -89,3 +103,13 @@ func (w *srvt) stop() {
 }
 
 type ServantHandler func(tickets.Ticket) error
+
+// ContextHandler handle ticket until ctx is cancelled, ctx is cancelled when master revokes the ticket or pool stops
+type ContextHandler func(context.Context, tickets.Ticket) error
+
+// WithContext adapt ServantHandler to ContextHandler, the handler can not be interrupted
+func (h ServantHandler) WithContext() ContextHandler {
+	return func(ctx context.Context, t tickets.Ticket) error {
+		return h(t)
+	}
+}
@@ -0,0 +1,109 @@
+package servant
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/qjpcpu/servant-cluster/tickets"
+)
+
+// waitIDs wait until all ids are received from c
+func waitIDs(t *testing.T, c <-chan string, ids ...string) {
+	t.Helper()
+	pending := make(map[string]bool)
+	for _, id := range ids {
+		pending[id] = true
+	}
+	deadline := time.After(time.Second)
+	for len(pending) > 0 {
+		select {
+		case id := <-c:
+			delete(pending, id)
+		case <-deadline:
+			t.Fatalf("tickets %v not seen", pending)
+		}
+	}
+}
+
+func TestContextHandlerCancel(t *testing.T) {
+	q := tickets.NewQueue()
+	startedC, cancelledC := make(chan string, 16), make(chan string, 16)
+	p := newPool(q, 2, time.Millisecond, func(ctx context.Context, tk tickets.Ticket) error {
+		startedC <- tk.ID
+		<-ctx.Done()
+		cancelledC <- tk.ID
+		return ctx.Err()
+	})
+	q.Set(tickets.Tickets{{ID: "a", Type: tickets.SolidTicket}, {ID: "b", Type: tickets.SolidTicket}})
+	waitIDs(t, startedC, "a", "b")
+	// revoke a
+	q.Set(tickets.Tickets{{ID: "b", Type: tickets.SolidTicket}})
+	waitIDs(t, cancelledC, "a")
+	select {
+	case id := <-cancelledC:
+		t.Fatalf("ticket %s should keep running", id)
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.Stop()
+	waitIDs(t, cancelledC, "b")
+}
+
+func TestOwnHandler(t *testing.T) {
+	q := tickets.NewQueue()
+	startedC, cancelledC := make(chan string, 16), make(chan string, 16)
+	p := newOwnerPool(q, time.Millisecond, func(ctx context.Context, tk tickets.Ticket) error {
+		startedC <- tk.ID
+		<-ctx.Done()
+		cancelledC <- tk.ID
+		return nil
+	})
+	a, b := tickets.Ticket{ID: "a", Type: tickets.SolidTicket}, tickets.Ticket{ID: "b", Type: tickets.SolidTicket}
+	q.Set(tickets.Tickets{a, b})
+	waitIDs(t, startedC, "a", "b")
+	// revoke a, b is kept by the same owner
+	q.Set(tickets.Tickets{b})
+	waitIDs(t, cancelledC, "a")
+	// reassign a
+	q.Set(tickets.Tickets{a, b})
+	waitIDs(t, startedC, "a")
+	select {
+	case id := <-startedC:
+		t.Fatalf("ticket %s should be owned only once", id)
+	case id := <-cancelledC:
+		t.Fatalf("ticket %s should keep owned", id)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if ids := p.OwnedIDs(); len(ids) != 2 {
+		t.Fatalf("both tickets should be owned: %v", ids)
+	}
+	p.Stop()
+	waitIDs(t, cancelledC, "a", "b")
+	if ids := p.OwnedIDs(); len(ids) != 0 {
+		t.Fatalf("no ticket should be owned after stop: %v", ids)
+	}
+}
+
+func TestOwnStaleTicket(t *testing.T) {
+	q := tickets.NewQueue()
+	q.Set(tickets.Tickets{{ID: "a", Type: tickets.SolidTicket}})
+	stale := <-q.RequestC()
+	// a is revoked after dequeued and before owned
+	q.Set(nil)
+	owned := make(chan string, 1)
+	p := newOwnerPool(q, time.Millisecond, func(ctx context.Context, tk tickets.Ticket) error {
+		owned <- tk.ID
+		<-ctx.Done()
+		return nil
+	})
+	defer p.Stop()
+	p.startOwn(stale)
+	select {
+	case <-owned:
+		t.Fatal("revoked ticket should not be owned")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if ids := p.OwnedIDs(); len(ids) != 0 {
+		t.Fatalf("stale ticket should be released: %v", ids)
+	}
+}
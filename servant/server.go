@@ -2,6 +2,9 @@ package servant
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/qjpcpu/servant-cluster/proto"
 	"github.com/qjpcpu/servant-cluster/tickets"
@@ -11,10 +14,14 @@ type TicketInfoServer struct {
 	Addr    string
 	tq      *tickets.Queue
 	sysFunc tickets.SysInfoGetter
+	// newest master seen
+	mutex    *sync.Mutex
+	masterID string
+	epoch    int64
 }
 
 func NewTicketInfoServer(tq *tickets.Queue, sysGetter tickets.SysInfoGetter) *TicketInfoServer {
-	ts := &TicketInfoServer{tq: tq, sysFunc: sysGetter}
+	ts := &TicketInfoServer{tq: tq, sysFunc: sysGetter, mutex: new(sync.Mutex)}
 	return ts
 }
 
@@ -23,12 +30,29 @@ func (s *TicketInfoServer) GetTickets(c context.Context, e *proto.Empty) (*proto
 	ti := &proto.TicketsInfo{}
 	for _, t := range ts {
 		pt := &proto.TicketInfo{
-			Id:      t.ID,
-			Type:    int32(t.Type),
-			Content: t.Content,
+			Id:           t.ID,
+			Type:         int32(t.Type),
+			Content:      t.Content,
+			Labels:       t.Labels,
+			Priority:     t.Priority,
+			Group:        t.Group,
+			AntiAffinity: t.AntiAffinity,
 		}
 		ti.TicketsInfo = append(ti.TicketsInfo, pt)
 	}
+	ti.RunningIds = s.tq.RunningIDs()
+	for _, st := range s.tq.States() {
+		ti.TicketStates = append(ti.TicketStates, &proto.TicketStatus{
+			Id:       st.ID,
+			State:    proto.TicketState(st.State),
+			Elapsed:  int64(time.Since(st.Since)),
+			Error:    st.Error,
+			Attempts: int32(st.Attempts),
+		})
+	}
+	s.mutex.Lock()
+	ti.MasterId, ti.Epoch = s.masterID, s.epoch
+	s.mutex.Unlock()
 	if s.sysFunc != nil {
 		stats, err := s.sysFunc()
 		if err != nil {
@@ -43,11 +67,21 @@ func (s *TicketInfoServer) SetTickets(c context.Context, info *proto.TicketsInfo
 	var ts tickets.Tickets
 	for _, t := range info.TicketsInfo {
 		ts = append(ts, tickets.Ticket{
-			ID:      t.Id,
-			Type:    tickets.TicketType(t.Type),
-			Content: t.Content,
+			ID:           t.Id,
+			Type:         tickets.TicketType(t.Type),
+			Content:      t.Content,
+			Labels:       t.Labels,
+			Priority:     t.Priority,
+			Group:        t.Group,
+			AntiAffinity: t.AntiAffinity,
 		})
 	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if info.Epoch < s.epoch {
+		return nil, fmt.Errorf("reject tickets of stale master %s epoch %d, newest master %s epoch %d", info.MasterId, info.Epoch, s.masterID, s.epoch)
+	}
+	s.masterID, s.epoch = info.MasterId, info.Epoch
 	err := s.tq.Set(ts)
 	return &proto.Empty{}, err
 }
@@ -0,0 +1,48 @@
+package tickets
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decide how failed tickets of a type are retried
+type RetryPolicy struct {
+	// failed runs before the ticket is dead lettered, 0 means retry forever
+	MaxAttempts int
+	// backoff after the first failure
+	InitialBackoff time.Duration
+	// upper bound of backoff, 0 means no bound
+	MaxBackoff time.Duration
+	// growth of backoff per failure, default 2
+	Multiplier float64
+	// random fraction 0-1 of backoff added or subtracted to spread retries
+	Jitter float64
+}
+
+// Backoff return delay before retry after attempts consecutive failures
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	// unbounded backoff is still capped by the largest duration
+	limit := float64(math.MaxInt64)
+	if p.MaxBackoff > 0 {
+		limit = float64(p.MaxBackoff)
+	}
+	backoff := float64(p.InitialBackoff)
+	for i := 1; i < attempts && backoff < limit; i++ {
+		backoff *= multiplier
+	}
+	if backoff > limit {
+		backoff = limit
+	}
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if backoff >= float64(math.MaxInt64) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(backoff)
+}
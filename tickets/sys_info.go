@@ -1,7 +1,54 @@
 package tickets
 
+import (
+	"encoding/json"
+	"errors"
+)
+
 type SysInfo struct {
 	Stats []byte
 }
 
 type SysInfoGetter func() ([]byte, error)
+
+// ServantStats is the encoding of system stats understood by master built-in dispatch
+type ServantStats struct {
+	// capacity weight of servant, tickets are dispatched in proportion to it
+	Weight int `json:"weight"`
+	// max tickets servant can hold, 0 means unlimited
+	MaxTickets int `json:"max_tickets,omitempty"`
+	// raw stats of user defined SysInfoGetter
+	Extra []byte `json:"extra,omitempty"`
+}
+
+// WeightedSysInfoGetter report weight along with the stats of getter, getter can be nil
+func WeightedSysInfoGetter(weight int, getter SysInfoGetter) SysInfoGetter {
+	return ServantStatsGetter(ServantStats{Weight: weight}, getter)
+}
+
+// ServantStatsGetter report weight and capacity in st along with the stats of getter, getter can be nil
+func ServantStatsGetter(st ServantStats, getter SysInfoGetter) SysInfoGetter {
+	return func() ([]byte, error) {
+		st := st
+		if getter != nil {
+			extra, err := getter()
+			if err != nil {
+				return nil, err
+			}
+			st.Extra = extra
+		}
+		return json.Marshal(st)
+	}
+}
+
+// ParseServantStats decode system stats reported by WeightedSysInfoGetter
+func ParseServantStats(stats []byte) (ServantStats, error) {
+	var st ServantStats
+	if len(stats) == 0 {
+		return st, errors.New("empty stats")
+	}
+	if err := json.Unmarshal(stats, &st); err != nil {
+		return st, err
+	}
+	return st, nil
+}
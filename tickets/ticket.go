@@ -13,14 +13,32 @@ const (
 )
 
 type Ticket struct {
-	ID       string
-	Content  []byte
-	Type     TicketType
-	revision uint64
+	ID      string
+	Content []byte
+	Type    TicketType
+	// labels required on servant which the ticket is dispatched to
+	Labels map[string]string
+	// higher priority tickets are dispatched first when servants capacity is insufficient
+	Priority int32
+	// tickets of the same group are dispatched to the same servant
+	Group string
+	// tickets sharing anti affinity key are spread across different servants and hosts
+	AntiAffinity string
+	revision     uint64
 }
 
 type Tickets []Ticket
 
+// MatchLabels check whether servant labels satisfy ticket required labels
+func (t Ticket) MatchLabels(labels map[string]string) bool {
+	for k, v := range t.Labels {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
 func (a Tickets) Len() int           { return len(a) }
 func (a Tickets) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a Tickets) Less(i, j int) bool { return a[i].ID < a[j].ID }
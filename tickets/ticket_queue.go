@@ -1,8 +1,12 @@
 package tickets
 
 import (
+	"context"
 	"errors"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/qjpcpu/common/joint"
@@ -10,14 +14,18 @@ import (
 
 func NewQueue() *Queue {
 	ticketq := &Queue{
-		in:    make(chan Ticket),
-		out:   make(chan Ticket),
-		sizeC: make(chan int, 1),
+		in:      make(chan Ticket),
+		out:     make(chan Ticket),
+		sizeC:   make(chan int, 1),
+		running: make(map[string]*runningTicket),
+		states:  make(map[string]*TicketStatus),
+		retries: make(map[TicketType]RetryPolicy),
+		mutex:   new(sync.Mutex),
 	}
 	pipe, _ := joint.Pipe(ticketq.in, ticketq.out)
 	pipe.SetFilter(func(tk interface{}) bool {
 		t := tk.(Ticket)
-		return t.revision >= atomic.LoadUint64(&ticketq.minRevision)
+		return t.revision >= atomic.LoadUint64(&ticketq.minRevision) && !ticketq.isDeadLetter(t.ID)
 	})
 	return ticketq
 }
@@ -27,6 +35,17 @@ type Queue struct {
 	ticketList  Tickets
 	in, out     chan Ticket
 	sizeC       chan int
+	running     map[string]*runningTicket
+	states      map[string]*TicketStatus
+	retries     map[TicketType]RetryPolicy
+	mutex       *sync.Mutex
+}
+
+// runningTicket is handlers running one ticket, they share a context cancelled on revocation
+type runningTicket struct {
+	count  int
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (ticketq *Queue) Set(list Tickets) error {
@@ -34,7 +53,11 @@ func (ticketq *Queue) Set(list Tickets) error {
 	if !atomic.CompareAndSwapPointer((*unsafe.Pointer)((unsafe.Pointer)(&ticketq.ticketList)), ptr, unsafe.Pointer(&list)) {
 		return errors.New("set tickets fail")
 	}
+	// BeginWork checks revision under mutex, so no stale ticket starts after states are updated
+	ticketq.mutex.Lock()
+	ticketq.updateStates(list)
 	minRevision := atomic.AddUint64(&ticketq.minRevision, 1)
+	ticketq.mutex.Unlock()
 	for i := range list {
 		list[i].revision = minRevision
 		ticketq.in <- list[i]
@@ -67,8 +90,186 @@ func (ticketq *Queue) Recycle(t Ticket) {
 	if t.Type == OnceTicket {
 		return
 	}
+	ticketq.requeue(t)
+}
+
+func (ticketq *Queue) requeue(t Ticket) {
 	if t.revision < atomic.LoadUint64(&ticketq.minRevision) {
 		return
 	}
 	ticketq.in <- t
 }
+
+// SetRetryPolicy set retry policy of failed tickets of type tp
+func (ticketq *Queue) SetRetryPolicy(tp TicketType, p RetryPolicy) {
+	ticketq.mutex.Lock()
+	defer ticketq.mutex.Unlock()
+	ticketq.retries[tp] = p
+}
+
+// RecycleFailed retry failed ticket after backoff of its type retry policy, including OnceTicket,
+// or dead letter it and return true when attempts run out, ticket type without policy is recycled after fallback
+func (ticketq *Queue) RecycleFailed(t Ticket, fallback time.Duration) bool {
+	ticketq.mutex.Lock()
+	policy, ok := ticketq.retries[t.Type]
+	st, assigned := ticketq.states[t.ID]
+	if !ok || !assigned {
+		ticketq.mutex.Unlock()
+		if fallback > 0 {
+			time.AfterFunc(fallback, func() { ticketq.Recycle(t) })
+		} else {
+			ticketq.Recycle(t)
+		}
+		return false
+	}
+	attempts := st.Attempts
+	if policy.MaxAttempts > 0 && attempts >= policy.MaxAttempts && st.State == TicketFailed {
+		st.State, st.Since = TicketDeadLetter, time.Now()
+		ticketq.mutex.Unlock()
+		return true
+	}
+	ticketq.mutex.Unlock()
+	time.AfterFunc(policy.Backoff(attempts), func() { ticketq.requeue(t) })
+	return false
+}
+
+func (ticketq *Queue) isDeadLetter(id string) bool {
+	ticketq.mutex.Lock()
+	defer ticketq.mutex.Unlock()
+	st, ok := ticketq.states[id]
+	return ok && st.State == TicketDeadLetter
+}
+
+// DeadLetters return states of dead lettered tickets sorted by id
+func (ticketq *Queue) DeadLetters() []TicketStatus {
+	var list []TicketStatus
+	for _, st := range ticketq.States() {
+		if st.State == TicketDeadLetter {
+			list = append(list, st)
+		}
+	}
+	return list
+}
+
+// updateStates start new and dead lettered tickets as assigned and mark running tickets removed by list as revoked
+func (ticketq *Queue) updateStates(list Tickets) {
+	now := time.Now()
+	assigned := make(map[string]bool)
+	for _, t := range list {
+		assigned[t.ID] = true
+		st, ok := ticketq.states[t.ID]
+		if !ok {
+			ticketq.states[t.ID] = &TicketStatus{ID: t.ID, State: TicketAssigned, Since: now}
+		} else if st.State == TicketRevoked {
+			st.State, st.Since = TicketRunning, now
+		} else if st.State == TicketDeadLetter {
+			// master sets it again, start over with fresh attempts
+			st.State, st.Since, st.Attempts, st.Error = TicketAssigned, now, 0, ""
+		}
+	}
+	for id, st := range ticketq.states {
+		if assigned[id] {
+			continue
+		}
+		if rt, ok := ticketq.running[id]; ok {
+			if st.State != TicketRevoked {
+				st.State, st.Since = TicketRevoked, now
+				rt.cancel()
+			}
+		} else {
+			delete(ticketq.states, id)
+		}
+	}
+	// handlers of tickets without state, such as started before their state was dropped
+	for id, rt := range ticketq.running {
+		if _, ok := ticketq.states[id]; !ok && !assigned[id] {
+			rt.cancel()
+		}
+	}
+}
+
+// BeginWork mark ticket handler running, return context of the run derived from parent,
+// it is cancelled when the ticket is revoked by Set, return false without marking if ticket
+// is dequeued before a newer Set, the caller should drop it and must not call EndWork
+func (ticketq *Queue) BeginWork(parent context.Context, t Ticket) (context.Context, bool) {
+	ticketq.mutex.Lock()
+	defer ticketq.mutex.Unlock()
+	if t.revision < atomic.LoadUint64(&ticketq.minRevision) {
+		return nil, false
+	}
+	rt, ok := ticketq.running[t.ID]
+	if !ok {
+		rt = new(runningTicket)
+		ticketq.running[t.ID] = rt
+	}
+	// revoked and then assigned again while old handlers are running
+	if rt.ctx == nil || rt.ctx.Err() != nil {
+		rt.ctx, rt.cancel = context.WithCancel(parent)
+	}
+	rt.count++
+	if st, ok := ticketq.states[t.ID]; ok && st.State != TicketRunning && st.State != TicketRevoked && st.State != TicketDeadLetter {
+		st.State, st.Since = TicketRunning, time.Now()
+	}
+	return rt.ctx, true
+}
+
+// EndWork mark ticket handler finished with its error
+func (ticketq *Queue) EndWork(t Ticket, err error) {
+	ticketq.mutex.Lock()
+	defer ticketq.mutex.Unlock()
+	rt, ok := ticketq.running[t.ID]
+	if !ok {
+		return
+	}
+	if rt.count--; rt.count <= 0 {
+		rt.cancel()
+		delete(ticketq.running, t.ID)
+	}
+	st, ok := ticketq.states[t.ID]
+	if !ok {
+		return
+	}
+	if err != nil {
+		st.Error = err.Error()
+		st.Attempts++
+	} else {
+		st.Attempts = 0
+	}
+	if rt.count > 0 {
+		return
+	}
+	switch {
+	case st.State == TicketDeadLetter:
+		// a copy queued before dead lettered
+	case st.State == TicketRevoked:
+		delete(ticketq.states, t.ID)
+	case err != nil:
+		st.State, st.Since = TicketFailed, time.Now()
+	default:
+		st.State, st.Since, st.Error = TicketAcknowledged, time.Now(), ""
+	}
+}
+
+// States return states of assigned and revoked tickets sorted by id
+func (ticketq *Queue) States() []TicketStatus {
+	ticketq.mutex.Lock()
+	defer ticketq.mutex.Unlock()
+	var list []TicketStatus
+	for _, st := range ticketq.states {
+		list = append(list, *st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// RunningIDs return ids of tickets whose handler is running, including revoked tickets
+func (ticketq *Queue) RunningIDs() []string {
+	ticketq.mutex.Lock()
+	defer ticketq.mutex.Unlock()
+	var ids []string
+	for id := range ticketq.running {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,50 @@
+package tickets
+
+import "time"
+
+// TicketState is lifecycle of a ticket on servant
+type TicketState int32
+
+const (
+	// received from master, no worker has started it yet
+	TicketAssigned TicketState = iota
+	// started by a worker, not running now
+	TicketAcknowledged
+	TicketRunning
+	// last run failed
+	TicketFailed
+	// removed by master while its handler is still running
+	TicketRevoked
+	// retry attempts ran out, not run until master sets it again
+	TicketDeadLetter
+)
+
+func (s TicketState) String() string {
+	switch s {
+	case TicketAssigned:
+		return "assigned"
+	case TicketAcknowledged:
+		return "acknowledged"
+	case TicketRunning:
+		return "running"
+	case TicketFailed:
+		return "failed"
+	case TicketRevoked:
+		return "revoked"
+	case TicketDeadLetter:
+		return "dead_letter"
+	}
+	return "unknown"
+}
+
+// TicketStatus is state of a ticket on servant
+type TicketStatus struct {
+	ID    string
+	State TicketState
+	// time of last state change
+	Since time.Time
+	// error of last failed run
+	Error string
+	// consecutive failed runs
+	Attempts int
+}
@@ -1,7 +1,10 @@
 package tickets
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestTQ(t *testing.T) {
@@ -25,3 +28,145 @@ func TestTQ(t *testing.T) {
 		t.Log(tk.ID)
 	}
 }
+
+func TestRunningIDs(t *testing.T) {
+	q := NewQueue()
+	tk := Ticket{ID: "1"}
+	q.BeginWork(context.Background(), tk)
+	q.BeginWork(context.Background(), tk)
+	q.EndWork(tk, nil)
+	if ids := q.RunningIDs(); len(ids) != 1 || ids[0] != "1" {
+		t.Fatalf("ticket 1 should be running: %v", ids)
+	}
+	q.EndWork(tk, nil)
+	if ids := q.RunningIDs(); len(ids) != 0 {
+		t.Fatalf("no ticket should be running: %v", ids)
+	}
+}
+
+func dequeue(t *testing.T, q *Queue, n int) map[string]Ticket {
+	m := make(map[string]Ticket)
+	for i := 0; i < n; i++ {
+		select {
+		case tk := <-q.RequestC():
+			m[tk.ID] = tk
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d tickets queued", i, n)
+		}
+	}
+	return m
+}
+
+func TestTicketStates(t *testing.T) {
+	q := NewQueue()
+	state := func(id string) TicketState {
+		for _, st := range q.States() {
+			if st.ID == id {
+				return st.State
+			}
+		}
+		return -1
+	}
+	q.Set(Tickets{{ID: "1"}, {ID: "2"}})
+	if state("1") != TicketAssigned || state("2") != TicketAssigned {
+		t.Fatalf("new tickets should be assigned: %v", q.States())
+	}
+	tks := dequeue(t, q, 2)
+	t1, t2 := tks["1"], tks["2"]
+	q.BeginWork(context.Background(), t1)
+	if state("1") != TicketRunning {
+		t.Fatal("ticket 1 should be running")
+	}
+	q.EndWork(t1, nil)
+	q.BeginWork(context.Background(), t2)
+	q.EndWork(t2, errors.New("boom"))
+	if state("1") != TicketAcknowledged || state("2") != TicketFailed {
+		t.Fatalf("bad states after run: %v", q.States())
+	}
+	ctx, _ := q.BeginWork(context.Background(), t1)
+	q.Set(Tickets{t2})
+	if state("1") != TicketRevoked || ctx.Err() == nil {
+		t.Fatal("running ticket removed by master should be revoked and cancelled")
+	}
+	q.EndWork(t1, nil)
+	if state("1") != -1 || len(q.States()) != 1 {
+		t.Fatalf("revoked ticket should be gone after run: %v", q.States())
+	}
+}
+
+func TestBeginStaleTicket(t *testing.T) {
+	q := NewQueue()
+	q.Set(Tickets{{ID: "1"}, {ID: "2"}})
+	tks := dequeue(t, q, 2)
+	// ticket 1 is dequeued by a worker but revoked before it starts
+	q.Set(Tickets{{ID: "2"}})
+	if _, ok := q.BeginWork(context.Background(), tks["1"]); ok {
+		t.Fatal("revoked ticket should not start")
+	}
+	if _, ok := q.BeginWork(context.Background(), tks["2"]); ok {
+		t.Fatal("ticket dequeued before newer Set should not start")
+	}
+	if ids := q.RunningIDs(); len(ids) != 0 {
+		t.Fatalf("no ticket should be running: %v", ids)
+	}
+	if _, ok := q.BeginWork(context.Background(), dequeue(t, q, 1)["2"]); !ok {
+		t.Fatal("ticket of newest Set should start")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: 3 * time.Millisecond}
+	if b := p.Backoff(1); b != time.Millisecond {
+		t.Fatalf("bad first backoff %v", b)
+	}
+	if b := p.Backoff(10); b != 3*time.Millisecond {
+		t.Fatalf("backoff should be bounded, got %v", b)
+	}
+	unbounded := RetryPolicy{InitialBackoff: time.Second, Jitter: 0.5}
+	if b := unbounded.Backoff(1000); b <= 0 {
+		t.Fatalf("unbounded backoff should not overflow, got %v", b)
+	}
+	q := NewQueue()
+	q.SetRetryPolicy(SolidTicket, p)
+	tk := Ticket{ID: "1", Type: SolidTicket}
+	q.Set(Tickets{tk})
+	tk = <-q.RequestC()
+	fail := errors.New("boom")
+	q.BeginWork(context.Background(), tk)
+	q.EndWork(tk, fail)
+	if q.RecycleFailed(tk, 0) {
+		t.Fatal("should retry before attempts run out")
+	}
+	select {
+	case tk = <-q.RequestC():
+	case <-time.After(time.Second):
+		t.Fatal("failed ticket should be retried after backoff")
+	}
+	q.BeginWork(context.Background(), tk)
+	q.EndWork(tk, fail)
+	if !q.RecycleFailed(tk, 0) {
+		t.Fatal("should dead letter when attempts run out")
+	}
+	if dl := q.DeadLetters(); len(dl) != 1 || dl[0].Attempts != 2 || dl[0].Error != "boom" {
+		t.Fatalf("bad dead letters %v", dl)
+	}
+	q.Recycle(tk)
+	select {
+	case <-q.RequestC():
+		t.Fatal("dead lettered ticket should not run again")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// recovered when master sets it again
+	q.Set(Tickets{tk})
+	select {
+	case tk = <-q.RequestC():
+	case <-time.After(time.Second):
+		t.Fatal("dead lettered ticket should run again after set")
+	}
+	if dl := q.DeadLetters(); len(dl) != 0 {
+		t.Fatalf("ticket should leave dead letters %v", dl)
+	}
+	if st := q.States(); len(st) != 1 || st[0].State != TicketAssigned || st[0].Attempts != 0 {
+		t.Fatalf("ticket should start over %v", st)
+	}
+}
@@ -1,5 +1,11 @@
 package util
 
+import (
+	"encoding/json"
+	"net"
+	"strings"
+)
+
 const (
 	ModuleName = "servant-cluster"
 )
@@ -12,9 +18,50 @@ func ServantKey(prefix string) string {
 	return prefix + "/servants"
 }
 
+func AssignmentKey(prefix string) string {
+	return prefix + "/assignment"
+}
+
+func TicketKey(prefix string) string {
+	return prefix + "/tickets"
+}
+
+func SuccessorKey(prefix string) string {
+	return prefix + "/successor"
+}
+
+func HistoryKey(prefix string) string {
+	return prefix + "/history"
+}
+
+// ServantHost return host part of servant id ip:port
+func ServantHost(sid string) string {
+	host, _, err := net.SplitHostPort(sid)
+	if err != nil {
+		return sid
+	}
+	return host
+}
+
 func Min(a, b int) int {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+// ServantMeta is registered by servant under ServantKey
+type ServantMeta struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ParseServantMeta parse registered value, value of old version servant is the plain servant id
+func ParseServantMeta(key string, value []byte) ServantMeta {
+	var meta ServantMeta
+	if err := json.Unmarshal(value, &meta); err != nil || meta.ID == "" {
+		tokens := strings.Split(key, "/")
+		meta = ServantMeta{ID: tokens[len(tokens)-1]}
+	}
+	return meta
+}